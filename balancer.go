@@ -0,0 +1,216 @@
+package esu
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BalancerPolicy specifies how a Balancer chooses between tasks.
+type BalancerPolicy int
+
+const (
+	// RoundRobin cycles through tasks in order.
+	RoundRobin BalancerPolicy = iota
+	// Random picks a task uniformly at random.
+	Random
+	// LeastOutstanding picks the task with the fewest in-flight requests.
+	LeastOutstanding
+	// PowerOfTwoChoices picks two tasks at random and uses the one with fewer
+	// in-flight requests.
+	PowerOfTwoChoices
+)
+
+// DefaultEjectionDuration is how long a task is taken out of rotation after a
+// connection error.
+const DefaultEjectionDuration = time.Second * 30
+
+// ErrNoTasks is returned when a balancer has no tasks to choose from.
+var ErrNoTasks = errors.New("no running tasks available")
+
+// Balancer selects between the running tasks of a service. It keeps itself up
+// to date by registering a task listener on a TaskMonitor.
+type Balancer struct {
+	Policy           BalancerPolicy
+	EjectionDuration time.Duration
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	next      int
+	rand      *rand.Rand
+	now       func() time.Time
+}
+
+// endpoint tracks per-task state for a balancer.
+type endpoint struct {
+	task         TaskInfo
+	outstanding  int
+	ejectedUntil time.Time
+}
+
+// NewBalancer returns a balancer that picks from the running tasks of a
+// monitor. The monitor's OnTaskChange callback is left untouched.
+func NewBalancer(tm *TaskMonitor, policy BalancerPolicy) *Balancer {
+	b := newBalancer(policy)
+	tm.AddTaskListener(b.Update)
+	b.Update(tm.RunningTasks())
+	return b
+}
+
+func newBalancer(policy BalancerPolicy) *Balancer {
+	return &Balancer{
+		Policy:           policy,
+		EjectionDuration: DefaultEjectionDuration,
+		rand:             rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:              time.Now,
+	}
+}
+
+// Update replaces the set of tasks the balancer chooses from. State for tasks
+// that are still present, such as in-flight counts and ejections, is kept.
+func (b *Balancer) Update(tasks []TaskInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	existing := map[string]*endpoint{}
+	for _, ep := range b.endpoints {
+		existing[ep.task.PrivateAddress()] = ep
+	}
+	endpoints := make([]*endpoint, len(tasks))
+	for i, t := range tasks {
+		if ep, ok := existing[t.PrivateAddress()]; ok {
+			ep.task = t
+			endpoints[i] = ep
+		} else {
+			endpoints[i] = &endpoint{task: t}
+		}
+	}
+	b.endpoints = endpoints
+}
+
+// Tasks returns the tasks the balancer is currently choosing from, including
+// ejected tasks.
+func (b *Balancer) Tasks() []TaskInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tasks := make([]TaskInfo, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		tasks[i] = ep.task
+	}
+	return tasks
+}
+
+// Pick selects a task according to the balancer's policy. Ejected tasks are
+// skipped unless every task is ejected, in which case all are considered.
+// Done must be called on the returned selection once the request completes.
+func (b *Balancer) Pick() (*Selection, error) {
+	return b.pick(nil)
+}
+
+// PickExcluding is like Pick but avoids the given tasks where possible, for
+// use when retrying a request on a different task.
+func (b *Balancer) PickExcluding(exclude ...TaskInfo) (*Selection, error) {
+	skip := map[string]bool{}
+	for _, t := range exclude {
+		skip[t.PrivateAddress()] = true
+	}
+	return b.pick(skip)
+}
+
+func (b *Balancer) pick(skip map[string]bool) (*Selection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	candidates := b.candidates(skip)
+	if len(candidates) == 0 {
+		return nil, ErrNoTasks
+	}
+
+	var ep *endpoint
+	switch b.Policy {
+	case Random:
+		ep = candidates[b.rand.Intn(len(candidates))]
+	case LeastOutstanding:
+		ep = candidates[0]
+		for _, c := range candidates[1:] {
+			if c.outstanding < ep.outstanding {
+				ep = c
+			}
+		}
+	case PowerOfTwoChoices:
+		i := b.rand.Intn(len(candidates))
+		ep = candidates[i]
+		if len(candidates) > 1 {
+			// Draw a second, distinct candidate.
+			j := b.rand.Intn(len(candidates) - 1)
+			if j >= i {
+				j++
+			}
+			if other := candidates[j]; other.outstanding < ep.outstanding {
+				ep = other
+			}
+		}
+	default:
+		ep = candidates[b.next%len(candidates)]
+		b.next++
+	}
+	ep.outstanding++
+	return &Selection{Task: ep.task, b: b, ep: ep}, nil
+}
+
+// candidates returns the endpoints eligible for selection, progressively
+// relaxing the skip list and ejections if nothing would otherwise be eligible.
+func (b *Balancer) candidates(skip map[string]bool) []*endpoint {
+	now := b.now()
+	var healthy, unskipped []*endpoint
+	for _, ep := range b.endpoints {
+		if skip[ep.task.PrivateAddress()] {
+			continue
+		}
+		unskipped = append(unskipped, ep)
+		if !now.Before(ep.ejectedUntil) {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	if len(unskipped) > 0 {
+		return unskipped
+	}
+	return b.endpoints
+}
+
+// Eject takes a task out of rotation for EjectionDuration.
+func (b *Balancer) Eject(task TaskInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addr := task.PrivateAddress()
+	for _, ep := range b.endpoints {
+		if ep.task.PrivateAddress() == addr {
+			ep.ejectedUntil = b.now().Add(b.EjectionDuration)
+		}
+	}
+}
+
+// Selection is a task chosen by a Balancer.
+type Selection struct {
+	Task TaskInfo
+	b    *Balancer
+	ep   *endpoint
+	done bool
+}
+
+// Done releases the selection. If connErr is non-nil the task is assumed to be
+// unreachable and is ejected from the balancer.
+func (s *Selection) Done(connErr error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	s.ep.outstanding--
+	if connErr != nil {
+		s.ep.ejectedUntil = s.b.now().Add(s.b.EjectionDuration)
+	}
+}
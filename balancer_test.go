@@ -0,0 +1,120 @@
+package esu
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func pickAddr(t *testing.T, b *Balancer) string {
+	s, err := b.Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Done(nil)
+	return s.Task.PrivateAddress()
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := newBalancer(RoundRobin)
+	b.Update([]TaskInfo{runningTask("10.0.0.1", 80), runningTask("10.0.0.2", 80)})
+	expected := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.1:80", "10.0.0.2:80"}
+	for i, e := range expected {
+		if a := pickAddr(t, b); a != e {
+			t.Errorf("pick %d was %s, wanted %s", i, a, e)
+		}
+	}
+}
+
+func TestBalancerLeastOutstanding(t *testing.T) {
+	b := newBalancer(LeastOutstanding)
+	b.Update([]TaskInfo{runningTask("10.0.0.1", 80), runningTask("10.0.0.2", 80)})
+	s1, _ := b.Pick()
+	s2, _ := b.Pick()
+	if s1.Task == s2.Task {
+		t.Errorf("expected second pick to use the idle task, both were %s", s1.Task.PrivateAddress())
+	}
+	s1.Done(nil)
+	s3, _ := b.Pick()
+	if s3.Task != s1.Task {
+		t.Errorf("expected released task %s, got %s", s1.Task.PrivateAddress(), s3.Task.PrivateAddress())
+	}
+}
+
+func TestBalancerPowerOfTwoChoices(t *testing.T) {
+	b := newBalancer(PowerOfTwoChoices)
+	b.Update([]TaskInfo{runningTask("10.0.0.1", 80), runningTask("10.0.0.2", 80)})
+	busy, _ := b.Pick()
+	// With two tasks both are always compared, so the idle one is picked.
+	for i := 0; i < 20; i++ {
+		s, _ := b.Pick()
+		if s.Task == busy.Task {
+			t.Fatalf("pick %d chose the busy task %s", i, s.Task.PrivateAddress())
+		}
+		s.Done(nil)
+	}
+}
+
+func TestBalancerEjection(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	b := newBalancer(RoundRobin)
+	b.now = clock.Now
+	b.Update([]TaskInfo{runningTask("10.0.0.1", 80), runningTask("10.0.0.2", 80)})
+
+	s, _ := b.Pick()
+	s.Done(errors.New("connection refused"))
+	for i := 0; i < 4; i++ {
+		if a := pickAddr(t, b); a != "10.0.0.2:80" {
+			t.Errorf("ejected task was picked: %s", a)
+		}
+	}
+
+	// Ejection state survives an update that keeps the task.
+	b.Update([]TaskInfo{runningTask("10.0.0.1", 80), runningTask("10.0.0.2", 80), runningTask("10.0.0.3", 80)})
+	for i := 0; i < 4; i++ {
+		if a := pickAddr(t, b); a == "10.0.0.1:80" {
+			t.Error("ejected task was picked after update")
+		}
+	}
+
+	clock.Advance(DefaultEjectionDuration)
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[pickAddr(t, b)] = true
+	}
+	if !seen["10.0.0.1:80"] {
+		t.Error("expected ejected task to return after ejection period")
+	}
+}
+
+func TestBalancerAllEjected(t *testing.T) {
+	b := newBalancer(Random)
+	if _, err := b.Pick(); err != ErrNoTasks {
+		t.Errorf("expected ErrNoTasks, was %v", err)
+	}
+	b.Update([]TaskInfo{runningTask("10.0.0.1", 80)})
+	b.Eject(runningTask("10.0.0.1", 80))
+	if a := pickAddr(t, b); a != "10.0.0.1:80" {
+		t.Errorf("expected ejected task to be used as a last resort, got %s", a)
+	}
+}
+
+func TestBalancerFollowsMonitor(t *testing.T) {
+	finder := &fakeFinder{tasks: []TaskInfo{runningTask("10.0.0.1", 80)}}
+	tm := NewTaskMonitorWithLister(finder, "website")
+	called := false
+	tm.OnTaskChange = func([]TaskInfo) { called = true }
+	b := NewBalancer(tm, PowerOfTwoChoices)
+	tm.Update()
+	if !called {
+		t.Error("OnTaskChange callback was not called")
+	}
+	if a := pickAddr(t, b); a != "10.0.0.1:80" {
+		t.Errorf("expected task from monitor, got %s", a)
+	}
+	finder.tasks = []TaskInfo{runningTask("10.0.0.2", 80)}
+	tm.Update()
+	if a := pickAddr(t, b); a != "10.0.0.2:80" {
+		t.Errorf("expected updated task from monitor, got %s", a)
+	}
+}
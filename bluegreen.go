@@ -0,0 +1,298 @@
+package esu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// DefaultBlueGreenDrain is how long the old service of a blue/green deploy
+// keeps running after traffic is switched away from it.
+const DefaultBlueGreenDrain = 30 * time.Second
+
+// TrafficSwitch moves traffic from one service of a blue/green deploy to the
+// other. tasks are the running tasks of the service traffic is moved to.
+type TrafficSwitch func(ctx context.Context, from, to string, tasks []TaskInfo) error
+
+// BlueGreenConfig configures the blue/green deploy strategy.
+type BlueGreenConfig struct {
+	// Standby is the name of the request service's counterpart. Whichever of
+	// the two has tasks is live, and the new revision is deployed to the other.
+	Standby string
+
+	// Switch moves traffic to the standby once its tasks are healthy. If nil,
+	// traffic is assumed to follow the running tasks, for example when both
+	// services are registered with the same load balancer.
+	Switch TrafficSwitch
+
+	// Drain is how long the old service keeps running after the switch, while
+	// the new tasks are watched. If they fail the switch is reversed. Defaults
+	// to DefaultBlueGreenDrain.
+	Drain time.Duration
+}
+
+// HTTPTrafficSwitch returns a switch that POSTs the services and the new
+// tasks' addresses to url as JSON, for example:
+//
+//	{"from": "website-blue", "to": "website-green", "addresses": ["10.0.0.1:8080"]}
+//
+// The switch fails unless the response has a 2xx status.
+func HTTPTrafficSwitch(client *http.Client, url string) TrafficSwitch {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return func(ctx context.Context, from, to string, tasks []TaskInfo) error {
+		body := struct {
+			From      string   `json:"from"`
+			To        string   `json:"to"`
+			Addresses []string `json:"addresses"`
+		}{from, to, []string{}}
+		for _, t := range tasks {
+			body.Addresses = append(body.Addresses, t.PrivateAddress())
+		}
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("POST %s returned %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// FileTrafficSwitch returns a switch that atomically writes the name of the
+// live service to path, for discovery tools that read it.
+func FileTrafficSwitch(path string) TrafficSwitch {
+	return func(ctx context.Context, from, to string, tasks []TaskInfo) error {
+		return WriteFileAtomic(path, []byte(to+"\n"), 0644)
+	}
+}
+
+// blueGreenServices returns which of a blue/green pair is live and which is on
+// standby. The live service is the one with tasks, and it is an error for both
+// or neither to have any, since there's no way to tell how many tasks to
+// start.
+func (d *Deployer) blueGreenServices(ctx context.Context, req DeployRequest) (string, string, error) {
+	a, err := d.describeService(ctx, req.Service)
+	if err != nil {
+		return "", "", err
+	}
+	b, err := d.describeService(ctx, req.BlueGreen.Standby)
+	if err != nil {
+		return "", "", err
+	}
+	activeA, activeB := aws.Int64Value(a.DesiredCount) > 0, aws.Int64Value(b.DesiredCount) > 0
+	if activeA && activeB {
+		return "", "", fmt.Errorf("both %s and %s have tasks, expected one to be on standby", req.Service, req.BlueGreen.Standby)
+	} else if !activeA && !activeB {
+		return "", "", fmt.Errorf("neither %s nor %s has tasks, scale one up before deploying", req.Service, req.BlueGreen.Standby)
+	} else if activeB {
+		return req.BlueGreen.Standby, req.Service, nil
+	}
+	return req.Service, req.BlueGreen.Standby, nil
+}
+
+// blueGreen deploys the new revision to the standby service, switches traffic
+// to it once all its tasks are healthy, then scales the live service to zero.
+// If the standby fails before the switch it is scaled back to zero, and if it
+// fails while the old service drains the switch is reversed.
+func (d *Deployer) blueGreen(ctx context.Context, req DeployRequest, result *DeployResult, plan *DeployPlan) error {
+	live, standby := plan.Live, plan.Standby
+	svc, err := d.describeService(ctx, live)
+	if err != nil {
+		return propagate(err, "failed to describe service")
+	}
+	count := aws.Int64Value(svc.DesiredCount)
+	if count == 0 {
+		return fmt.Errorf("%s has no tasks, scale it up before deploying", live)
+	}
+
+	d.progress(req, DeployStageUpdate, nil, "Starting %d tasks of %s in %s", count, result.Deployed, standby)
+	resp, err := d.ecs.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{
+		Cluster:        aws.String(d.Cluster),
+		Service:        aws.String(standby),
+		TaskDefinition: aws.String(result.Deployed.String()),
+		DesiredCount:   aws.Int64(count),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update service %s/%s -> %s: %s", d.Cluster, standby, result.Deployed, err)
+	}
+	if err := d.waitForRollout(ctx, req, resp.Service, result.Deployed); err != nil {
+		return d.abortBlueGreen(ctx, req, standby, err)
+	}
+	tasks, err := d.waitForHealthy(ctx, req, standby, result.Deployed, int(count), hasHealthCheck(plan.Input))
+	if err != nil {
+		return d.abortBlueGreen(ctx, req, standby, err)
+	}
+
+	d.progress(req, DeployStageSwitch, tasks, "Switching traffic from %s to %s", live, standby)
+	if err := d.switchTraffic(ctx, req, live, standby, tasks); err != nil {
+		return d.reverseBlueGreen(ctx, req, result, live, standby, err)
+	}
+
+	d.progress(req, DeployStageDrain, nil, "Draining %s for %s", live, req.BlueGreen.Drain)
+	if err := d.watchTasks(ctx, req, DeployStageDrain, standby, result.Deployed, d.now(), req.BlueGreen.Drain, nil); err != nil {
+		return d.reverseBlueGreen(ctx, req, result, live, standby, err)
+	}
+	d.progress(req, DeployStageDrain, nil, "Scaling %s to 0", live)
+	if err := d.scaleService(ctx, live, 0); err != nil {
+		return propagate(err, "failed to scale down "+live)
+	}
+	return nil
+}
+
+// waitForHealthy waits for a service to have count running tasks of a task
+// definition, as reported by the task lister. Tasks must be reported healthy if
+// the task definition has health checks, otherwise they must not be unhealthy.
+func (d *Deployer) waitForHealthy(ctx context.Context, req DeployRequest, service string, taskDef TaskDefinitionID, count int, healthChecked bool) ([]TaskInfo, error) {
+	start := d.now()
+	for {
+		tasks, err := d.tasks.Tasks(service)
+		if err != nil {
+			// Ignore errors while waiting for tasks.
+			d.progress(req, DeployStageWait, nil, "Failed to query tasks: %s", err)
+		}
+		healthy := []TaskInfo{}
+		for _, t := range tasks {
+			if t.TaskDefinition != taskDef || t.LastStatus != ECSTaskStatusRunning {
+				continue
+			}
+			if t.HealthStatus == ECSHealthStatusHealthy || (!healthChecked && t.HealthStatus != ECSHealthStatusUnhealthy) {
+				healthy = append(healthy, t)
+			}
+		}
+
+		wait := d.now().Sub(start)
+		if len(healthy) >= count {
+			d.progress(req, DeployStageWait, healthy, "All %d tasks of %s are healthy (%.fs)", count, service, wait.Seconds())
+			return healthy, nil
+		} else if wait > req.Timeout {
+			d.progress(req, DeployStageWait, tasks, "Timed out waiting for healthy tasks")
+			return nil, ErrDeployTimeout
+		}
+		d.progress(req, DeployStageWait, tasks, "Waiting for healthy tasks... (%.fs) %d/%d", wait.Seconds(), len(healthy), count)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(d.PollFreq):
+		}
+	}
+}
+
+// watchTasks watches a service's tasks of a task definition until duration
+// after since, failing if too many stop after since, ECS reports one
+// unhealthy, or the probe, if any, fails.
+func (d *Deployer) watchTasks(ctx context.Context, req DeployRequest, stage DeployStage, service string, taskDef TaskDefinitionID, since time.Time, duration time.Duration, probe CanaryProbe) error {
+	stopped := map[string]StoppedTask{}
+	end := since.Add(duration)
+	for {
+		if err := d.checkStopped(ctx, req, service, taskDef, time.Time{}, since, stopped); err != nil {
+			return err
+		}
+		tasks, err := d.tasks.Tasks(service)
+		if err != nil {
+			// Ignore errors while watching.
+			d.progress(req, stage, nil, "Failed to query tasks: %s", err)
+		}
+		for _, t := range tasks {
+			if t.HealthStatus == ECSHealthStatusUnhealthy {
+				return fmt.Errorf("task %s is unhealthy", t.TaskID())
+			}
+			if probe != nil && t.LastStatus == ECSTaskStatusRunning {
+				if err := probe(ctx, t); err != nil {
+					return fmt.Errorf("task %s failed probe: %s", t.TaskID(), err)
+				}
+			}
+		}
+
+		remaining := end.Sub(d.now())
+		if remaining <= 0 {
+			d.progress(req, stage, tasks, "Tasks of %s stayed healthy", service)
+			return nil
+		}
+		d.progress(req, stage, tasks, "Watching %s... (%s remaining)", service, remaining.Truncate(time.Second))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.PollFreq):
+		}
+	}
+}
+
+func (d *Deployer) switchTraffic(ctx context.Context, req DeployRequest, from, to string, tasks []TaskInfo) error {
+	if req.BlueGreen.Switch == nil {
+		return nil
+	}
+	if err := req.BlueGreen.Switch(ctx, from, to, tasks); err != nil {
+		return propagate(err, "traffic switch failed")
+	}
+	return nil
+}
+
+// abortBlueGreen scales the standby service back to zero after it failed to
+// start, leaving the live service untouched.
+func (d *Deployer) abortBlueGreen(ctx context.Context, req DeployRequest, standby string, err error) error {
+	d.progress(req, DeployStageRollback, nil, "Scaling %s to 0: %s", standby, err)
+	if serr := d.scaleService(ctx, standby, 0); serr != nil {
+		return fmt.Errorf("%s, scaling down %s failed: %s", err, standby, serr)
+	}
+	return err
+}
+
+// reverseBlueGreen switches traffic back to the old service and scales the
+// standby back to zero.
+func (d *Deployer) reverseBlueGreen(ctx context.Context, req DeployRequest, result *DeployResult, live, standby string, err error) error {
+	d.progress(req, DeployStageRollback, nil, "Switching traffic back to %s: %s", live, err)
+	tasks, terr := d.tasks.Tasks(live)
+	if terr != nil {
+		return fmt.Errorf("%s, rollback failed: %s", err, terr)
+	}
+	running := []TaskInfo{}
+	for _, t := range tasks {
+		if t.LastStatus == ECSTaskStatusRunning {
+			running = append(running, t)
+		}
+	}
+	if serr := d.switchTraffic(ctx, req, standby, live, running); serr != nil {
+		return fmt.Errorf("%s, rollback failed: %s", err, serr)
+	}
+	result.RolledBack = true
+	return d.abortBlueGreen(ctx, req, standby, err)
+}
+
+func (d *Deployer) scaleService(ctx context.Context, service string, count int64) error {
+	_, err := d.ecs.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{
+		Cluster:      aws.String(d.Cluster),
+		Service:      aws.String(service),
+		DesiredCount: aws.Int64(count),
+	})
+	return err
+}
+
+// hasHealthCheck returns true if any of a task definition's containers has a
+// health check.
+func hasHealthCheck(def *ecs.RegisterTaskDefinitionInput) bool {
+	for _, c := range def.ContainerDefinitions {
+		if c.HealthCheck != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package esu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func blueGreenRequest(tag string, switches *[]string) DeployRequest {
+	return DeployRequest{
+		Service:  "website",
+		Tag:      tag,
+		Strategy: StrategyBlueGreen,
+		BlueGreen: &BlueGreenConfig{
+			Standby: "website-green",
+			Drain:   5 * time.Millisecond,
+			Switch: func(ctx context.Context, from, to string, tasks []TaskInfo) error {
+				*switches = append(*switches, fmt.Sprintf("%s->%s (%d)", from, to, len(tasks)))
+				return nil
+			},
+		},
+	}
+}
+
+func desiredCounts(f *fakeECS) string {
+	return fmt.Sprintf("website=%d website-green=%d",
+		*f.services["website"].DesiredCount, *f.services["website-green"].DesiredCount)
+}
+
+func TestDeployBlueGreen(t *testing.T) {
+	f := newFakeECS("website:v1")
+	f.addService("website-green", "website:1", 0)
+	d, _ := testDeployer(f)
+
+	switches := []string{}
+	result, err := d.Deploy(context.Background(), blueGreenRequest("v2", &switches))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deployed.String() != "website:2" || result.RolledBack {
+		t.Errorf("unexpected result: %#v", result)
+	}
+	if fmt.Sprint(f.updates) != "map[website-green:[website:2]]" {
+		t.Errorf("only the standby should be updated: %v", f.updates)
+	}
+	if fmt.Sprint(switches) != "[website->website-green (2)]" {
+		t.Errorf("unexpected switches: %v", switches)
+	}
+	if s := desiredCounts(f); s != "website=0 website-green=2" {
+		t.Errorf("unexpected counts: %s", s)
+	}
+
+	// The next deploy goes back the other way.
+	plan, err := d.Plan(context.Background(), blueGreenRequest("v3", &switches))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Live != "website-green" || plan.Standby != "website" || len(plan.Replaced) != 2 {
+		t.Errorf("unexpected plan: %s", plan)
+	}
+	if _, err := d.Deploy(context.Background(), blueGreenRequest("v3", &switches)); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(switches) != "[website->website-green (2) website-green->website (2)]" {
+		t.Errorf("unexpected switches: %v", switches)
+	}
+	if s := desiredCounts(f); s != "website=2 website-green=0" {
+		t.Errorf("unexpected counts: %s", s)
+	}
+}
+
+func TestDeployBlueGreenFailed(t *testing.T) {
+	// The standby never becomes ready, so traffic is never switched.
+	f := newFakeECS("website:v1")
+	f.addService("website-green", "website:1", 0)
+	f.rollout["website:2"] = ecs.DeploymentRolloutStateInProgress
+	d, _ := testDeployer(f)
+
+	switches := []string{}
+	req := blueGreenRequest("v2", &switches)
+	req.Timeout = 5 * time.Millisecond
+	if _, err := d.Deploy(context.Background(), req); err != ErrDeployTimeout {
+		t.Errorf("expected timeout, was %v", err)
+	}
+	if len(switches) != 0 {
+		t.Errorf("traffic shouldn't be switched: %v", switches)
+	}
+	if s := desiredCounts(f); s != "website=2 website-green=0" {
+		t.Errorf("unexpected counts: %s", s)
+	}
+
+	// The new tasks crash after the switch, so it's reversed.
+	f = newFakeECS("website:v1")
+	f.addService("website-green", "website:1", 0)
+	d, _ = testDeployer(f)
+	req = blueGreenRequest("v2", &switches)
+	req.BlueGreen.Drain = time.Minute
+	record := req.BlueGreen.Switch
+	req.BlueGreen.Switch = func(ctx context.Context, from, to string, tasks []TaskInfo) error {
+		if to == "website-green" {
+			for i := 0; i < 3; i++ {
+				task := crashedTask(i)
+				task.Group = aws.String("service:website-green")
+				task.StoppedAt = aws.Time(time.Now().Add(time.Minute))
+				f.stopped = append(f.stopped, task)
+			}
+		}
+		return record(ctx, from, to, tasks)
+	}
+	result, err := d.Deploy(context.Background(), req)
+	if _, ok := err.(*CrashLoopError); !ok {
+		t.Errorf("expected CrashLoopError, was %v", err)
+	}
+	if !result.RolledBack {
+		t.Errorf("expected rollback: %#v", result)
+	}
+	if fmt.Sprint(switches) != "[website->website-green (2) website-green->website (2)]" {
+		t.Errorf("unexpected switches: %v", switches)
+	}
+	if s := desiredCounts(f); s != "website=2 website-green=0" {
+		t.Errorf("unexpected counts: %s", s)
+	}
+}
+
+func TestDeployBlueGreenInvalid(t *testing.T) {
+	f := newFakeECS("website:v1")
+	f.addService("website-green", "website:1", 1)
+	d, _ := testDeployer(f)
+
+	switches := []string{}
+	if _, err := d.Deploy(context.Background(), blueGreenRequest("v2", &switches)); err == nil {
+		t.Errorf("expected error when both services have tasks")
+	}
+	req := blueGreenRequest("v2", &switches)
+	req.BlueGreen.Standby = ""
+	if _, err := d.Deploy(context.Background(), req); err == nil {
+		t.Errorf("expected error without a standby service")
+	}
+	f.services["website"].DesiredCount = aws.Int64(0)
+	f.services["website-green"].DesiredCount = aws.Int64(0)
+	if _, err := d.Deploy(context.Background(), blueGreenRequest("v2", &switches)); err == nil || !strings.Contains(err.Error(), "neither website nor website-green has tasks") {
+		t.Errorf("expected error when neither service has tasks, was %v", err)
+	}
+	if len(f.registered) != 0 || len(f.updates) != 0 {
+		t.Errorf("nothing should be registered or updated: %v %v", f.registered, f.updates)
+	}
+}
+
+func TestTrafficSwitches(t *testing.T) {
+	tasks := []TaskInfo{runningTask("10.0.0.1", 8080)}
+
+	path := filepath.Join(t.TempDir(), "live")
+	if err := FileTrafficSwitch(path)(context.Background(), "website", "website-green", tasks); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "website-green\n" {
+		t.Errorf("unexpected file contents %q", b)
+	}
+
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["to"] == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	sw := HTTPTrafficSwitch(nil, srv.URL)
+	if err := sw(context.Background(), "website", "website-green", tasks); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(body) != "map[addresses:[10.0.0.1:8080] from:website to:website-green]" {
+		t.Errorf("unexpected body %v", body)
+	}
+	if err := sw(context.Background(), "website", "fail", tasks); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -0,0 +1,286 @@
+package esu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// DefaultCanaryBakeTime is how long canary tasks must stay healthy before the
+// new revision is promoted.
+const DefaultCanaryBakeTime = 5 * time.Minute
+
+// DefaultCanarySuffix is appended to a service's name to name its canary.
+const DefaultCanarySuffix = "-canary"
+
+// CanaryProbe checks whether a canary task is working, returning an error if
+// not.
+type CanaryProbe func(ctx context.Context, task TaskInfo) error
+
+// CanaryConfig configures the canary deploy strategy.
+type CanaryConfig struct {
+	// Service is the name of the canary service. Defaults to the service's
+	// name with DefaultCanarySuffix.
+	Service string
+
+	// Count is how many canary tasks to run. Defaults to one.
+	Count int
+
+	// BakeTime is how long canary tasks must stay healthy before the new
+	// revision is promoted. Defaults to DefaultCanaryBakeTime.
+	BakeTime time.Duration
+
+	// Probe, if set, is called for each canary task throughout the bake.
+	Probe CanaryProbe
+}
+
+// HTTPProbe returns a probe that sends a GET request for path to each task,
+// and fails unless the response has a 2xx status.
+func HTTPProbe(client *http.Client, path string) CanaryProbe {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return func(ctx context.Context, task TaskInfo) error {
+		req, err := http.NewRequest(http.MethodGet, "http://"+task.PrivateAddress()+path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("GET %s returned %s", req.URL, resp.Status)
+		}
+		return nil
+	}
+}
+
+// Stages of a canary deploy, in order.
+const (
+	canaryStageCreate  = "create"
+	canaryStageBake    = "bake"
+	canaryStagePromote = "promote"
+)
+
+// canaryState records the progress of a canary deploy, so it can be resumed if
+// interrupted.
+type canaryState struct {
+	Service        string
+	CanaryService  string
+	TaskDefinition TaskDefinitionID
+	Previous       TaskDefinitionID
+	Stage          string
+	BakeStarted    time.Time
+}
+
+// canary runs the new revision in a separate canary service, and promotes it
+// to the main service once the canary has baked. If state is nil a new canary
+// deploy is started, otherwise the one it describes is resumed. The canary
+// service is removed whether or not the deploy succeeds.
+func (d *Deployer) canary(ctx context.Context, req DeployRequest, result *DeployResult, state *canaryState) error {
+	cfg := req.Canary
+	if state == nil {
+		state = &canaryState{
+			Service:        req.Service,
+			CanaryService:  cfg.Service,
+			TaskDefinition: result.Deployed,
+			Previous:       result.Previous,
+			Stage:          canaryStageCreate,
+		}
+		if err := d.saveCanaryState(state); err != nil {
+			return err
+		}
+	}
+
+	if state.Stage == canaryStageCreate {
+		d.progress(req, DeployStageCanary, nil, "Starting %d canary tasks of %s in %s", cfg.Count, state.TaskDefinition, state.CanaryService)
+		if err := d.startCanary(ctx, req, state); err != nil {
+			return d.abortCanary(ctx, req, state, err)
+		}
+		state.Stage = canaryStageBake
+		state.BakeStarted = d.now()
+		if err := d.saveCanaryState(state); err != nil {
+			return err
+		}
+	}
+
+	if state.Stage == canaryStageBake {
+		remaining := cfg.BakeTime - d.now().Sub(state.BakeStarted)
+		d.progress(req, DeployStageBake, nil, "Baking canary for %s", remaining.Truncate(time.Second))
+		if err := d.watchTasks(ctx, req, DeployStageBake, state.CanaryService, state.TaskDefinition, state.BakeStarted, cfg.BakeTime, cfg.Probe); err != nil {
+			return d.abortCanary(ctx, req, state, err)
+		}
+		state.Stage = canaryStagePromote
+		if err := d.saveCanaryState(state); err != nil {
+			return err
+		}
+	}
+
+	d.progress(req, DeployStagePromote, nil, "Promoting %s to %s", state.TaskDefinition, req.Service)
+	err := d.rollingUpdate(ctx, req, result)
+	if ctx.Err() != nil {
+		// Leave the canary in place so the promotion can be resumed.
+		return err
+	}
+	if rerr := d.removeCanary(ctx, req, state); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// checkCanaryState returns an error unless the plan would deploy the same
+// revision as the saved canary deploy, so an in-progress canary is only
+// resumed by repeating the deploy that started it.
+func (d *Deployer) checkCanaryState(ctx context.Context, plan *DeployPlan, state *canaryState) error {
+	resp, err := d.ecs.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(state.TaskDefinition.String()),
+	})
+	if err != nil {
+		return propagate(err, "failed to query task definition")
+	}
+	if len(DiffTaskDefinitions(CloneTaskDefinition(resp.TaskDefinition, nil), plan.Input)) > 0 {
+		return fmt.Errorf("canary deploy of %s to %s already in progress (%s), repeat it to resume or remove %s to abandon it",
+			state.TaskDefinition, state.Service, state.Stage, d.canaryStatePath(state.Service))
+	}
+	return nil
+}
+
+// startCanary creates the canary service, copying the main service's
+// configuration, or updates it if it already exists, and waits for its tasks
+// to start.
+func (d *Deployer) startCanary(ctx context.Context, req DeployRequest, state *canaryState) error {
+	var svc *ecs.Service
+	existing, err := d.describeService(ctx, state.CanaryService)
+	if err == nil && aws.StringValue(existing.Status) == "ACTIVE" {
+		resp, err := d.ecs.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{
+			Cluster:        aws.String(d.Cluster),
+			Service:        aws.String(state.CanaryService),
+			TaskDefinition: aws.String(state.TaskDefinition.String()),
+			DesiredCount:   aws.Int64(int64(req.Canary.Count)),
+		})
+		if err != nil {
+			return propagate(err, "failed to update canary service")
+		}
+		svc = resp.Service
+	} else {
+		main, err := d.describeService(ctx, req.Service)
+		if err != nil {
+			return propagate(err, "failed to describe service")
+		}
+		// The role is only for services using classic load balancers without
+		// awsvpc networking, otherwise ECS uses its service-linked role and
+		// rejects an explicit one.
+		role := main.RoleArn
+		if main.NetworkConfiguration != nil || strings.Contains(aws.StringValue(role), ":role/aws-service-role/") {
+			role = nil
+		}
+		resp, err := d.ecs.CreateServiceWithContext(ctx, &ecs.CreateServiceInput{
+			Cluster:                       aws.String(d.Cluster),
+			ServiceName:                   aws.String(state.CanaryService),
+			TaskDefinition:                aws.String(state.TaskDefinition.String()),
+			DesiredCount:                  aws.Int64(int64(req.Canary.Count)),
+			LaunchType:                    main.LaunchType,
+			CapacityProviderStrategy:      main.CapacityProviderStrategy,
+			PlatformVersion:               main.PlatformVersion,
+			NetworkConfiguration:          main.NetworkConfiguration,
+			PlacementConstraints:          main.PlacementConstraints,
+			PlacementStrategy:             main.PlacementStrategy,
+			LoadBalancers:                 main.LoadBalancers,
+			ServiceRegistries:             main.ServiceRegistries,
+			Role:                          role,
+			HealthCheckGracePeriodSeconds: main.HealthCheckGracePeriodSeconds,
+			EnableECSManagedTags:          main.EnableECSManagedTags,
+			PropagateTags:                 main.PropagateTags,
+		})
+		if err != nil {
+			return propagate(err, "failed to create canary service")
+		}
+		svc = resp.Service
+	}
+	return d.waitForRollout(ctx, req, svc, state.TaskDefinition)
+}
+
+// abortCanary removes a failed canary, leaving the main service untouched. If
+// the deploy was interrupted, the canary is left for it to be resumed.
+func (d *Deployer) abortCanary(ctx context.Context, req DeployRequest, state *canaryState, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	d.progress(req, DeployStageRollback, nil, "Canary failed: %s", err)
+	if rerr := d.removeCanary(ctx, req, state); rerr != nil {
+		return fmt.Errorf("canary failed: %s, removing canary failed: %s", err, rerr)
+	}
+	return fmt.Errorf("canary failed: %w", err)
+}
+
+// removeCanary deletes the canary service and the saved state.
+func (d *Deployer) removeCanary(ctx context.Context, req DeployRequest, state *canaryState) error {
+	d.progress(req, DeployStageCanary, nil, "Removing canary service %s", state.CanaryService)
+	_, err := d.ecs.DeleteServiceWithContext(ctx, &ecs.DeleteServiceInput{
+		Cluster: aws.String(d.Cluster),
+		Service: aws.String(state.CanaryService),
+		Force:   aws.Bool(true),
+	})
+	if err != nil {
+		return propagate(err, "failed to delete canary service")
+	}
+	return d.clearCanaryState(state.Service)
+}
+
+func (d *Deployer) canaryStatePath(service string) string {
+	return filepath.Join(d.StateDir, fmt.Sprintf("%s.%s.canary.json", d.Cluster, service))
+}
+
+// loadCanaryState returns the saved state of an interrupted canary deploy, or
+// nil if there isn't one.
+func (d *Deployer) loadCanaryState(service string) (*canaryState, error) {
+	if d.StateDir == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(d.canaryStatePath(service))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &canaryState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, propagate(err, "invalid canary state")
+	}
+	return state, nil
+}
+
+func (d *Deployer) saveCanaryState(state *canaryState) error {
+	if d.StateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(d.StateDir, 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(d.canaryStatePath(state.Service), b, 0644)
+}
+
+func (d *Deployer) clearCanaryState(service string) error {
+	if d.StateDir == "" {
+		return nil
+	}
+	if err := os.Remove(d.canaryStatePath(service)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package esu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func canaryRequest(probe CanaryProbe) DeployRequest {
+	return DeployRequest{
+		Service:  "website",
+		Tag:      "v2",
+		Strategy: StrategyCanary,
+		Canary:   &CanaryConfig{BakeTime: 5 * time.Millisecond, Probe: probe},
+	}
+}
+
+func TestDeployCanary(t *testing.T) {
+	f := newFakeECS("website:v1")
+	d, events := testDeployer(f)
+
+	probed := map[string]bool{}
+	probe := func(ctx context.Context, task TaskInfo) error {
+		probed[task.TaskDefinition.String()] = true
+		return nil
+	}
+	result, err := d.Deploy(context.Background(), canaryRequest(probe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deployed.String() != "website:2" || result.RolledBack {
+		t.Errorf("unexpected result: %#v", result)
+	}
+	if fmt.Sprint(f.updates) != "map[website:[website:2] website-canary:[website:2]]" {
+		t.Errorf("unexpected updates: %v", f.updates)
+	}
+	if !probed["website:2"] || len(probed) != 1 {
+		t.Errorf("expected canary tasks to be probed: %v", probed)
+	}
+	if fmt.Sprint(f.deleted) != "[website-canary]" {
+		t.Errorf("expected canary to be removed: %v", f.deleted)
+	}
+	stages := []DeployStage{}
+	for _, e := range *events {
+		if len(stages) == 0 || stages[len(stages)-1] != e.Stage {
+			stages = append(stages, e.Stage)
+		}
+	}
+	if s := fmt.Sprint(stages); s != "[check register canary wait bake promote update wait canary done]" {
+		t.Errorf("unexpected stages: %s", s)
+	}
+
+	// awsvpc services use the service-linked role, so none is passed.
+	f = newFakeECS("website:v1")
+	main := f.services["website"]
+	main.RoleArn = aws.String("arn:aws:iam::12345678:role/ecsServiceRole")
+	main.NetworkConfiguration = &ecs.NetworkConfiguration{AwsvpcConfiguration: &ecs.AwsVpcConfiguration{Subnets: []*string{aws.String("subnet-1")}}}
+	main.ServiceRegistries = []*ecs.ServiceRegistry{{RegistryArn: aws.String("arn:aws:servicediscovery:us-east-1:12345678:service/srv-1")}}
+	d, _ = testDeployer(f)
+	if _, err := d.Deploy(context.Background(), canaryRequest(nil)); err != nil {
+		t.Fatal(err)
+	}
+	canary := f.services["website-canary"]
+	if canary.RoleArn != nil || len(canary.ServiceRegistries) != 1 {
+		t.Errorf("unexpected canary role %v and registries %v", canary.RoleArn, canary.ServiceRegistries)
+	}
+}
+
+func TestDeployCanaryFailed(t *testing.T) {
+	f := newFakeECS("website:v1")
+	d, _ := testDeployer(f)
+	d.StateDir = t.TempDir()
+
+	probe := func(ctx context.Context, task TaskInfo) error {
+		return errors.New("500 Internal Server Error")
+	}
+	_, err := d.Deploy(context.Background(), canaryRequest(probe))
+	if err == nil || !strings.Contains(err.Error(), "failed probe: 500 Internal Server Error") {
+		t.Errorf("expected probe failure, was %v", err)
+	}
+	if len(f.updates["website"]) != 0 || *f.services["website"].TaskDefinition != "website:1" {
+		t.Errorf("main service shouldn't be updated: %v", f.updates)
+	}
+	if fmt.Sprint(f.deleted) != "[website-canary]" {
+		t.Errorf("expected canary to be removed: %v", f.deleted)
+	}
+	if _, err := os.Stat(d.canaryStatePath("website")); !os.IsNotExist(err) {
+		t.Errorf("expected state to be cleared: %v", err)
+	}
+
+	// Crashing canary tasks fail the bake too.
+	f = newFakeECS("website:v1")
+	for i := 0; i < 3; i++ {
+		task := crashedTask(i)
+		task.Group = aws.String("service:website-canary")
+		task.StoppedAt = aws.Time(time.Now().Add(time.Minute))
+		f.stopped = append(f.stopped, task)
+	}
+	d, _ = testDeployer(f)
+	req := canaryRequest(nil)
+	req.Canary.BakeTime = time.Hour
+	_, err = d.Deploy(context.Background(), req)
+	var crashErr *CrashLoopError
+	if !errors.As(err, &crashErr) {
+		t.Errorf("expected crash loop, was %v", err)
+	}
+	if len(f.updates["website"]) != 0 {
+		t.Errorf("main service shouldn't be updated: %v", f.updates)
+	}
+}
+
+func TestDeployCanaryResume(t *testing.T) {
+	f := newFakeECS("website:v1")
+	f.RegisterTaskDefinitionWithContext(context.Background(), &ecs.RegisterTaskDefinitionInput{
+		Family:               aws.String("website"),
+		ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("website"), Image: aws.String("website:v2")}},
+	})
+	f.addService("website-canary", "website:2", 1)
+	d, _ := testDeployer(f)
+	d.StateDir = t.TempDir()
+
+	state := &canaryState{
+		Service:        "website",
+		CanaryService:  "website-canary",
+		TaskDefinition: TaskDefinitionID{"website", 2},
+		Previous:       TaskDefinitionID{"website", 1},
+		Stage:          canaryStageBake,
+		BakeStarted:    time.Now().Add(-time.Hour),
+	}
+	if err := d.saveCanaryState(state); err != nil {
+		t.Fatal(err)
+	}
+	// Canary tasks which stopped before the bake started aren't counted.
+	for i := 0; i < 3; i++ {
+		task := crashedTask(i)
+		task.Group = aws.String("service:website-canary")
+		f.stopped = append(f.stopped, task)
+	}
+
+	// A different deploy doesn't resume the canary.
+	other := canaryRequest(nil)
+	other.Tag = "v3"
+	if _, err := d.Deploy(context.Background(), other); err == nil || !strings.Contains(err.Error(), "canary deploy of website:2 to website already in progress") {
+		t.Errorf("expected canary in progress, was %v", err)
+	}
+	if len(f.defs) != 2 || len(f.updates) != 0 {
+		t.Errorf("nothing should change while a canary is in progress: %d %v", len(f.defs), f.updates)
+	}
+
+	req := canaryRequest(nil)
+	req.Canary.BakeTime = time.Minute
+	result, err := d.Deploy(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deployed.String() != "website:2" || result.Previous.String() != "website:1" {
+		t.Errorf("unexpected result: %#v", result)
+	}
+	if len(f.defs) != 2 {
+		t.Errorf("resumed deploy shouldn't register a revision: %d", len(f.defs))
+	}
+	if fmt.Sprint(f.updates) != "map[website:[website:2]]" || fmt.Sprint(f.deleted) != "[website-canary]" {
+		t.Errorf("unexpected updates: %v %v", f.updates, f.deleted)
+	}
+	if s, err := d.loadCanaryState("website"); s != nil || err != nil {
+		t.Errorf("expected state to be cleared: %v %v", s, err)
+	}
+}
+
+func TestDeployCanaryInterrupted(t *testing.T) {
+	f := newFakeECS("website:v1")
+	d, _ := testDeployer(f)
+	d.StateDir = filepath.Join(t.TempDir(), "state")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.OnProgress = func(e DeployEvent) {
+		if e.Stage == DeployStageBake {
+			cancel()
+		}
+	}
+	req := canaryRequest(nil)
+	req.Canary.BakeTime = time.Hour
+	if _, err := d.Deploy(ctx, req); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected deploy to be cancelled, was %v", err)
+	}
+	if len(f.deleted) != 0 {
+		t.Errorf("expected canary to be left to resume: %v", f.deleted)
+	}
+	if s, err := d.loadCanaryState("website"); s == nil || s.Stage != canaryStageBake {
+		t.Errorf("expected state to be saved: %v %v", s, err)
+	}
+}
+
+func TestCanaryState(t *testing.T) {
+	d, _ := testDeployer(newFakeECS("website:v1"))
+	d.StateDir = t.TempDir()
+
+	if s, err := d.loadCanaryState("website"); s != nil || err != nil {
+		t.Errorf("expected no state: %v %v", s, err)
+	}
+	ioutil.WriteFile(filepath.Join(d.StateDir, "sites.website.canary.json"), []byte("{"), 0644)
+	if _, err := d.loadCanaryState("website"); err == nil {
+		t.Errorf("expected error loading invalid state")
+	}
+}
+
+func TestDeployInvalidStrategy(t *testing.T) {
+	d, _ := testDeployer(newFakeECS("website:v1"))
+	if _, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2", Strategy: "bluegreen"}); err == nil {
+		t.Errorf("expected error for unknown strategy")
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	task := runningTask(host, p)
+
+	probe := HTTPProbe(nil, "/health")
+	if err := probe(context.Background(), task); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := probe(context.Background(), task); err == nil {
+		t.Errorf("expected error for %d", status)
+	}
+}
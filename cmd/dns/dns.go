@@ -0,0 +1,67 @@
+// DNS server that answers A and SRV queries for the running tasks of ECS
+// services, for consumers that can't use the library directly.
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dpup/esu"
+	"github.com/dpup/esu/cmd/internal/naming"
+	"github.com/dpup/esu/dnsserver"
+)
+
+var (
+	region   = flag.String("region", "us-east-1", "Which EC2 region to use")
+	cluster  = flag.String("cluster", "", "Cluster the services run on")
+	services = flag.String("services", "", "Comma separated list of services to answer queries for")
+	addr     = flag.String("addr", ":5353", "Address to listen on, for both UDP and TCP")
+	domain   = flag.String("domain", dnsserver.DefaultDomain, "Domain to answer queries for")
+	ttl      = flag.Duration("ttl", dnsserver.DefaultTTL, "TTL of answers")
+	negTTL   = flag.Duration("negative-ttl", dnsserver.DefaultNegativeTTL, "TTL for NXDOMAIN responses")
+)
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if *cluster, err = naming.Cluster(*cluster); err != nil {
+		log.Fatalln("failed to resolve cluster:", err)
+	}
+
+	if *cluster == "" || *services == "" {
+		log.Fatalln("--cluster (or --env) and --services are required")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:                        region,
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	})
+	if err != nil {
+		log.Fatalln("failed to create session:", err)
+	}
+
+	s := dnsserver.New()
+	s.Domain = *domain
+	s.TTL = *ttl
+	s.NegativeTTL = *negTTL
+
+	for _, service := range strings.Split(*services, ",") {
+		service := strings.TrimSpace(service)
+		tm := esu.NewTaskMonitor(sess, *cluster, service)
+		tm.OnTaskChange = func(tasks []esu.TaskInfo) {
+			log.Printf("%s: %d running tasks", service, len(tasks))
+		}
+		tm.OnError = func(err error) {
+			log.Printf("%s: error: %s", service, err)
+		}
+		tm.Monitor()
+		s.AddService(*cluster, service, tm)
+	}
+
+	log.Printf("Answering queries for *.%s.%s on %s", *cluster, *domain, *addr)
+	log.Fatalln(s.ListenAndServe(*addr))
+}
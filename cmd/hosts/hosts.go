@@ -0,0 +1,72 @@
+// Command which maintains a managed block in a hosts file, mapping service
+// names to the IPs of their running tasks, for containers that can't run a DNS
+// resolver.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dpup/esu"
+	"github.com/dpup/esu/cmd/internal/naming"
+	"github.com/dpup/esu/hostsfile"
+)
+
+var (
+	region   = flag.String("region", "us-east-1", "Which EC2 region to use")
+	cluster  = flag.String("cluster", "", "Cluster the services run on")
+	services = flag.String("services", "", "Comma separated list of services to write entries for")
+	path     = flag.String("file", "/etc/hosts", "Hosts file to maintain")
+	domain   = flag.String("domain", "", "Optional domain to append to each name")
+)
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if *cluster, err = naming.Cluster(*cluster); err != nil {
+		log.Fatalln("failed to resolve cluster:", err)
+	}
+
+	if *cluster == "" || *services == "" {
+		log.Fatalln("--cluster (or --env) and --services are required")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:                        region,
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	})
+	if err != nil {
+		log.Fatalln("failed to create session:", err)
+	}
+
+	w := hostsfile.New(*path)
+	w.Domain = *domain
+	w.OnError = func(err error) {
+		log.Println("failed to write hosts file:", err)
+	}
+
+	for _, service := range strings.Split(*services, ",") {
+		service := strings.TrimSpace(service)
+		tm := esu.NewTaskMonitor(sess, *cluster, service)
+		tm.OnTaskChange = func(tasks []esu.TaskInfo) {
+			log.Printf("%s: %d running tasks", service, len(tasks))
+		}
+		tm.OnError = func(err error) {
+			log.Printf("%s: error: %s", service, err)
+		}
+		w.AddService(tm)
+		defer func(c chan<- bool) { c <- true }(tm.Monitor())
+	}
+
+	// Wait for ctrl+c to exit.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	log.Println("Exiting")
+}
@@ -0,0 +1,67 @@
+// Package naming provides the flags commands share for resolving cluster names
+// and task definition families from an environment, using an esu.Naming
+// convention. Explicit --cluster and --family flags always take precedence.
+package naming
+
+import (
+	"flag"
+
+	"github.com/dpup/esu"
+)
+
+var (
+	env             = flag.String("env", "", "Environment to derive the cluster and task definition family from")
+	config          = flag.String("naming", "", "JSON file mapping environments to clusters and services to task definition families")
+	clusterTemplate = flag.String("cluster-template", "", "Cluster name for an environment, e.g. {env}-cluster")
+	familyTemplate  = flag.String("family-template", "", "Task definition family for a service, e.g. {env}-{service}")
+)
+
+// Env returns the environment given with --env.
+func Env() string {
+	return *env
+}
+
+// Convention returns the naming convention from --naming, with any templates
+// from flags taking precedence.
+func Convention() (*esu.Naming, error) {
+	n := &esu.Naming{}
+	if *config != "" {
+		var err error
+		if n, err = esu.LoadNaming(*config); err != nil {
+			return nil, err
+		}
+	}
+	if *clusterTemplate != "" {
+		n.ClusterTemplate = *clusterTemplate
+	}
+	if *familyTemplate != "" {
+		n.FamilyTemplate = *familyTemplate
+	}
+	return n, nil
+}
+
+// Cluster returns override if set, otherwise the cluster of the --env
+// environment, or "" if there is no environment.
+func Cluster(override string) (string, error) {
+	if override != "" || *env == "" {
+		return override, nil
+	}
+	n, err := Convention()
+	if err != nil {
+		return "", err
+	}
+	return n.Cluster(*env)
+}
+
+// Family returns override if set, otherwise the task definition family of the
+// service in the --env environment, or "" if there is no environment.
+func Family(override, service string) (string, error) {
+	if override != "" || *env == "" {
+		return override, nil
+	}
+	n, err := Convention()
+	if err != nil {
+		return "", err
+	}
+	return n.Family(*env, service)
+}
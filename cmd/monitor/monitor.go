@@ -10,6 +10,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/dpup/esu"
+	"github.com/dpup/esu/cmd/internal/naming"
 )
 
 var region = flag.String("region", "us-east-1", "Which EC2 region to use")
@@ -19,6 +20,12 @@ var service = flag.String("service", "", "The service to monitor")
 func main() {
 	flag.Parse()
 
+	var err error
+	if *cluster, err = naming.Cluster(*cluster); err != nil {
+		log.Println("failed to resolve cluster:", err)
+		os.Exit(1)
+	}
+
 	sess, err := session.NewSession(&aws.Config{
 		Region: region,
 		CredentialsChainVerboseErrors: aws.Bool(true),
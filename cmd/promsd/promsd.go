@@ -0,0 +1,76 @@
+// Command which exports ECS tasks as Prometheus scrape targets, writing a
+// file_sd_configs file and/or serving the http_sd_configs endpoint.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dpup/esu/cmd/internal/naming"
+	"github.com/dpup/esu/promsd"
+)
+
+var (
+	region      = flag.String("region", "us-east-1", "Which EC2 region to use")
+	cluster     = flag.String("cluster", "", "Cluster to export tasks for")
+	services    = flag.String("services", "", "Comma separated list of services to export, defaults to all")
+	file        = flag.String("file", "", "Path to write file_sd_configs JSON to")
+	addr        = flag.String("addr", "", "Address to serve http_sd_configs on")
+	interval    = flag.Duration("interval", 30*time.Second, "How often to query ECS")
+	metricsPort = flag.Int("metrics-port", 0, "Container port metrics are served on, defaults to the canonical port")
+	metricsPath = flag.String("metrics-path", "", "Path to scrape, defaults to Prometheus' /metrics")
+)
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if *cluster, err = naming.Cluster(*cluster); err != nil {
+		log.Fatalln("failed to resolve cluster:", err)
+	}
+
+	if *cluster == "" || (*file == "" && *addr == "") {
+		log.Fatalln("--cluster (or --env) and one of --file or --addr are required")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:                        region,
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	})
+	if err != nil {
+		log.Fatalln("failed to create session:", err)
+	}
+
+	e := promsd.New(sess, *cluster)
+	e.MetricsPort = *metricsPort
+	e.MetricsPath = *metricsPath
+	if *services != "" {
+		e.Services = strings.Split(*services, ",")
+	}
+
+	if *addr != "" {
+		go func() {
+			log.Fatalln(http.ListenAndServe(*addr, e))
+		}()
+	}
+
+	for {
+		// Services which failed keep their previous targets, so the rest are
+		// still written.
+		if err := e.Refresh(); err != nil {
+			log.Println("failed to refresh targets:", err)
+		}
+		log.Printf("Found %d targets", len(e.TargetGroups()))
+		if *file != "" {
+			if err := e.WriteFile(*file); err != nil {
+				log.Println("failed to write targets:", err)
+			}
+		}
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,133 @@
+// Command which listens on a local port per service and forwards connections to
+// the service's running tasks, so sidecar style deployments can reach services
+// without an ELB.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dpup/esu"
+	"github.com/dpup/esu/cmd/internal/naming"
+	"github.com/dpup/esu/proxy"
+)
+
+// routes is a repeatable flag of "port=service" pairs.
+type routes map[string]string
+
+func (r routes) String() string {
+	parts := []string{}
+	for port, service := range r {
+		parts = append(parts, port+"="+service)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r routes) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected port=service, was %q", v)
+	}
+	r[parts[0]] = parts[1]
+	return nil
+}
+
+var (
+	region    = flag.String("region", "us-east-1", "Which EC2 region to use")
+	cluster   = flag.String("cluster", "", "Cluster the services run on")
+	host      = flag.String("host", "localhost", "Host to listen on")
+	statsAddr = flag.String("stats", "", "Address to serve per-backend stats on, as JSON")
+	drain     = flag.Duration("drain", proxy.DefaultDrainTimeout, "How long to let connections to stopped tasks finish")
+
+	httpRoutes = routes{}
+	tcpRoutes  = routes{}
+)
+
+func main() {
+	flag.Var(httpRoutes, "http", "Proxy HTTP on a port to a service, e.g. 8001=website (repeatable)")
+	flag.Var(tcpRoutes, "tcp", "Proxy raw TCP on a port to a service, e.g. 9001=redis (repeatable)")
+	flag.Parse()
+
+	var err error
+	if *cluster, err = naming.Cluster(*cluster); err != nil {
+		log.Fatalln("failed to resolve cluster:", err)
+	}
+
+	if len(httpRoutes) == 0 && len(tcpRoutes) == 0 {
+		log.Fatalln("at least one --http or --tcp route is required")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:                        region,
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	})
+	if err != nil {
+		log.Fatalln("failed to create session:", err)
+	}
+
+	proxies := map[string]*proxy.Proxy{}
+	errs := make(chan error)
+
+	for port, service := range httpRoutes {
+		p := newProxy(sess, service)
+		proxies[port] = p
+		addr := net.JoinHostPort(*host, port)
+		log.Printf("Proxying HTTP on %s to %s", addr, service)
+		go func(addr string, p *proxy.Proxy) {
+			errs <- http.ListenAndServe(addr, p)
+		}(addr, p)
+	}
+
+	for port, service := range tcpRoutes {
+		p := newProxy(sess, service)
+		proxies[port] = p
+		addr := net.JoinHostPort(*host, port)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalln("failed to listen:", err)
+		}
+		log.Printf("Proxying TCP on %s to %s", addr, service)
+		go func(l net.Listener, p *proxy.Proxy) {
+			errs <- p.ServeTCP(l)
+		}(l, p)
+	}
+
+	if *statsAddr != "" {
+		go func() {
+			errs <- http.ListenAndServe(*statsAddr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				stats := map[string][]proxy.BackendStats{}
+				for port, p := range proxies {
+					stats[port+"="+p.Service] = p.Stats()
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(stats)
+			}))
+		}()
+	}
+
+	log.Fatalln(<-errs)
+}
+
+func newProxy(sess *session.Session, service string) *proxy.Proxy {
+	tm := esu.NewTaskMonitor(sess, *cluster, service)
+	tm.OnTaskChange = func(tasks []esu.TaskInfo) {
+		log.Printf("%s: available tasks:", service)
+		for _, task := range tasks {
+			log.Println("  ", task)
+		}
+	}
+	tm.OnError = func(err error) {
+		log.Printf("%s: error: %s", service, err)
+	}
+	p := proxy.New(tm, esu.LeastOutstanding)
+	p.DrainTimeout = *drain
+	tm.Monitor()
+	return p
+}
@@ -0,0 +1,43 @@
+// Command which serves a JSON discovery API for ECS services, backed by cached
+// TaskMonitors, for dashboards and scripts that can't use the library.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dpup/esu/httpapi"
+)
+
+var (
+	region   = flag.String("region", "us-east-1", "Which EC2 region to use")
+	clusters = flag.String("clusters", "", "Comma separated list of clusters that may be queried, defaults to any")
+	addr     = flag.String("addr", ":8080", "Address to serve the API on")
+)
+
+func main() {
+	flag.Parse()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:                        region,
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	})
+	if err != nil {
+		log.Fatalln("failed to create session:", err)
+	}
+
+	s := httpapi.New(sess)
+	if *clusters != "" {
+		s.Clusters = strings.Split(*clusters, ",")
+	}
+	s.OnError = func(err error) {
+		log.Println("monitor error:", err)
+	}
+
+	log.Printf("Serving discovery API on %s", *addr)
+	log.Fatalln(http.ListenAndServe(*addr, s))
+}
@@ -0,0 +1,127 @@
+// Command which watches services and renders templates, such as HAProxy or
+// nginx upstream configs, running a reload command when the output changes.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dpup/esu"
+	"github.com/dpup/esu/cmd/internal/naming"
+	"github.com/dpup/esu/configtemplate"
+)
+
+// templates is a repeatable flag of "source:dest[:command]" values.
+type templates []*configtemplate.Template
+
+func (t *templates) String() string {
+	parts := []string{}
+	for _, tmpl := range *t {
+		parts = append(parts, tmpl.Source+":"+tmpl.Dest)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (t *templates) Set(v string) error {
+	parts := strings.SplitN(v, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected source:dest[:command], was %q", v)
+	}
+	tmpl := &configtemplate.Template{Source: parts[0], Dest: parts[1]}
+	if len(parts) == 3 {
+		tmpl.Command = parts[2]
+	}
+	*t = append(*t, tmpl)
+	return nil
+}
+
+var (
+	region   = flag.String("region", "us-east-1", "Which EC2 region to use")
+	cluster  = flag.String("cluster", "", "Cluster the services run on")
+	services = flag.String("services", "", "Comma separated list of services to make available to templates")
+	debounce = flag.Duration("debounce", configtemplate.DefaultDebounce, "How long changes must settle before rendering")
+	maxWait  = flag.Duration("max-wait", configtemplate.DefaultMaxWait, "Longest a stream of changes can delay rendering")
+	retry    = flag.Duration("retry", configtemplate.DefaultRetryInterval, "How long to wait before retrying a failed render")
+	once     = flag.Bool("once", false, "Render templates once and exit")
+
+	tmpls templates
+)
+
+func main() {
+	flag.Var(&tmpls, "template", "Template to render, as source:dest[:reload command] (repeatable)")
+	flag.Parse()
+
+	var err error
+	if *cluster, err = naming.Cluster(*cluster); err != nil {
+		log.Fatalln("failed to resolve cluster:", err)
+	}
+
+	if *cluster == "" || *services == "" || len(tmpls) == 0 {
+		log.Fatalln("--cluster (or --env), --services and --template are required")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:                        region,
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	})
+	if err != nil {
+		log.Fatalln("failed to create session:", err)
+	}
+
+	r := configtemplate.New(tmpls...)
+	r.Debounce = *debounce
+	r.MaxWait = *maxWait
+	r.RetryInterval = *retry
+	r.OnRender = func(t *configtemplate.Template, out []byte) {
+		log.Printf("Rendered %s to %s", t.Source, t.Dest)
+		if len(out) > 0 {
+			log.Printf("  %s", out)
+		}
+	}
+	r.OnError = func(err error) {
+		log.Println("render error:", err)
+	}
+
+	monitors := []*esu.TaskMonitor{}
+	for _, service := range strings.Split(*services, ",") {
+		service := strings.TrimSpace(service)
+		tm := esu.NewTaskMonitor(sess, *cluster, service)
+		tm.OnError = func(err error) {
+			log.Printf("%s: error: %s", service, err)
+		}
+		r.AddService(tm)
+		monitors = append(monitors, tm)
+	}
+
+	if *once {
+		for _, tm := range monitors {
+			tm.Update()
+		}
+		// Fails if a service couldn't be listed, rather than rendering it
+		// with no tasks.
+		if err := r.Render(); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	for _, tm := range monitors {
+		defer func(c chan<- bool) { c <- true }(tm.Monitor())
+	}
+	// Render immediately, rather than waiting for the debounced first change.
+	if err := r.Render(); err != nil {
+		log.Println("render error:", err)
+	}
+
+	// Wait for ctrl+c to exit.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	log.Println("Exiting")
+}
@@ -4,260 +4,194 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/dpup/esu"
+	"github.com/dpup/esu/cmd/internal/naming"
 )
 
+// images is a repeatable flag of "container=image" pairs.
+type images map[string]string
+
+func (i images) String() string {
+	parts := []string{}
+	for name, image := range i {
+		parts = append(parts, name+"="+image)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (i images) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected container=image, was %q", v)
+	}
+	i[parts[0]] = parts[1]
+	return nil
+}
+
 var (
 	region  = flag.String("region", "us-east-1", "Which EC2 region to use")
-	world   = flag.String("world", "", "World service belongs to")
+	cluster = flag.String("cluster", "", "Cluster the service runs on, defaults to the cluster of --env")
+	family  = flag.String("family", "", "Task definition family to deploy, defaults to the family of --service in --env")
+	world   = flag.String("world", "", "Deprecated: use --env")
 	service = flag.String("service", "", "The service to update")
-	tag     = flag.String("tag", "", "Tag of the new image to deploy")
+	tag     = flag.String("tag", "", "Tag of the new image to deploy to the service's canonical container")
 
 	timeout = flag.Duration("timeout", 2*time.Minute, "How long to wait for the task to deploy before reverting")
-	force   = flag.Bool("force", false, "Whether to update the task definition regardless of current state. No rollback on failure.")
+	force   = flag.Bool("force", false, "Whether to update the task definition regardless of current state.")
+	plan    = flag.Bool("plan", false, "Print the changes a deploy would make, without making them")
 
-	errTimeout = errors.New("Timeout")
-)
+	maxStopped = flag.Int("max-stopped", esu.DefaultMaxStoppedTasks, "How many new tasks may stop before rolling back without waiting for the timeout, -1 to disable")
 
-// TODO:
-// - Consider moving querying of task definitions into TaskFinder.
-// - Verify timeout/rollback.
-// - Try to cleanup tag vs. revision vs. task definition.
+	canary      = flag.Bool("canary", false, "Run the new revision in a canary service before updating the service")
+	canaryCount = flag.Int("canary-count", 1, "How many canary tasks to run")
+	bake        = flag.Duration("bake", esu.DefaultCanaryBakeTime, "How long canary tasks must stay healthy before promoting")
+	probe       = flag.String("probe", "", "HTTP path to GET on each canary task while baking, e.g. /health")
+	stateDir    = flag.String("state-dir", defaultStateDir(), "Directory to save canary progress in, so interrupted deploys can resume")
 
-func main() {
-	flag.Parse()
+	standby    = flag.String("blue-green", "", "Standby service to deploy to, switching traffic to it once healthy")
+	switchURL  = flag.String("switch-url", "", "URL to POST to when switching traffic between blue/green services")
+	switchFile = flag.String("switch-file", "", "File to write the live service to when switching traffic between blue/green services")
+	drain      = flag.Duration("drain", esu.DefaultBlueGreenDrain, "How long to keep the old blue/green service running after switching traffic")
 
-	cluster := fmt.Sprintf("%s-cluster", *world)
-	taskDef := fmt.Sprintf("%s-%s", *world, *service)
+	lockDir    = flag.String("lock-dir", "", "Directory to keep deploy locks in, to stop concurrent deploys from this machine")
+	lockTable  = flag.String("lock-table", "", "DynamoDB table to keep deploy locks in, to stop concurrent deploys of the service")
+	lockHolder = flag.String("lock-holder", esu.DefaultLockHolder(), "Who is deploying, recorded in the deploy lock")
+	lockLease  = flag.Duration("lock-lease", esu.DefaultLockLease, "How long a deploy lock lasts if not renewed")
+	breakLock  = flag.Bool("break-lock", false, "Deploy even if another deploy holds the lock")
 
-	log.Printf("Preparing to deploy %s on %s", taskDef, cluster)
+	containerImages = images{}
+)
 
-	sess, err := session.NewSession(&aws.Config{
-		Region: region,
-		CredentialsChainVerboseErrors: aws.Bool(true),
-	})
-	if err != nil {
-		log.Fatalln("failed to create session:", err)
-	}
+func main() {
+	flag.Var(containerImages, "image", "Image to deploy to a container, e.g. worker=worker:v2 (repeatable)")
+	flag.Parse()
 
-	tf := esu.NewTaskFinder(sess, cluster)
-	tasks, err := tf.Tasks(*service)
-	if err != nil {
-		log.Fatalln("failed to query tasks:", err)
+	if *tag == "" && len(containerImages) == 0 {
+		log.Fatalln("--tag or --image is required")
 	}
-
-	svc := ecs.New(sess)
-
-	if len(tasks) > 0 {
-		defs, err := loadCurrentTaskDefinitions(svc, tasks)
-		if err != nil {
-			log.Fatalln("failed to query Task Definition:", err)
-		}
-
-		if checkTag(defs, *tag) && checkFamily(defs, taskDef) {
-			log.Println("All tasks are up to date")
-			return
-		}
-
-		if !isStable(defs) {
-			log.Println("Tasks aren't stable. Multiple revisions active:")
-			for _, task := range tasks {
-				log.Println("  ", task)
-			}
-			if !*force {
-				os.Exit(1)
-				return
-			}
-		}
-	} else {
-		log.Print("No tasks currently running")
+	if *canary && *standby != "" {
+		log.Fatalln("--canary and --blue-green can't be used together")
 	}
 
-	log.Printf("Update required")
-
-	// Use most recent task definition as a template for the service update.
-	template, err := getLatestTaskDef(svc, taskDef)
-	if err != nil {
-		log.Fatalln("Failed to fetch task definition:", err)
-		return
+	if *world != "" && naming.Env() == "" {
+		flag.Set("env", *world)
 	}
-	log.Printf("Using %s:%d as template", *template.Family, *template.Revision)
-
-	newTaskDef, err := updateTaskDef(svc, template, *tag)
-	if err != nil {
-		log.Fatalln("Failed to update task definition:", err)
-		return
+	var err error
+	if *cluster, err = naming.Cluster(*cluster); err != nil {
+		log.Fatalln("failed to resolve cluster:", err)
 	}
-
-	// Try to update the service.
-	if err := updateService(tf, svc, newTaskDef, cluster, *service, *timeout); err != nil {
-		if err == errTimeout {
-			oldTaskDef := esu.ParseARN(*template.TaskDefinitionArn).ShortName()
-			log.Printf("Rolling back to %s", oldTaskDef)
-			if err := updateService(tf, svc, oldTaskDef, cluster, *service, *timeout); err != nil {
-				log.Println("Error rolling back", err)
-			}
-		} else {
-			log.Println("Unexpected error:", err)
-		}
-		log.Println("Failure :(")
-		os.Exit(1)
+	if *cluster == "" || *service == "" {
+		log.Fatalln("--cluster (or --env) and --service are required")
 	}
-
-	log.Println("Success!")
-}
-
-func updateService(tf *esu.TaskFinder, svc *ecs.ECS,
-	taskDef, cluster, service string, timeout time.Duration) error {
-
-	resp, err := svc.UpdateService(&ecs.UpdateServiceInput{
-		Cluster:        aws.String(cluster),
-		Service:        aws.String(service),
-		TaskDefinition: aws.String(taskDef),
-	})
+	taskDef, err := naming.Family(*family, *service)
 	if err != nil {
-		return fmt.Errorf("failed to update service %s/%s -> %s: %s",
-			cluster, service, taskDef, err)
+		log.Fatalln("failed to resolve task definition family:", err)
+	} else if taskDef == "" {
+		taskDef = *service
 	}
 
-	log.Println("Service updated to:", *resp.Service.TaskDefinition)
+	log.Printf("Preparing to deploy %s on %s", taskDef, *cluster)
 
-	start := time.Now()
-	for {
-		time.Sleep(5 * time.Second)
-
-		tasks, err := tf.Tasks(service)
-		if err != nil {
-			// Ignore error while waiting for update.
-			log.Println("Failed to query tasks:", err)
-			continue
-		}
-
-		wait := time.Since(start)
-		for _, task := range tasks {
-			log.Println("  ", task)
-		}
-
-		if checkTask(tasks, taskDef) {
-			log.Printf("All tasks updated!! (%.fs)", wait.Seconds())
-
-			return nil
-
-		} else if wait > timeout {
-			log.Println("Timedout waiting for tasks to update.")
-			return errTimeout
-
-		} else {
-			log.Printf("Waiting... (%.fs)", wait.Seconds())
-		}
-	}
-}
-
-func updateTaskDef(svc *ecs.ECS, template *ecs.TaskDefinition, tag string) (string, error) {
-	containerDef := template.ContainerDefinitions[0]
-	imageARN := esu.ParseARN(*containerDef.Image)
-	imageARN.Revision = tag
-	containerDef.Image = aws.String(imageARN.String())
-	resp, err := svc.RegisterTaskDefinition(&ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions: []*ecs.ContainerDefinition{containerDef},
-		TaskRoleArn:          template.TaskRoleArn,
-		Family:               template.Family,
+	sess, err := session.NewSession(&aws.Config{
+		Region:                        region,
+		CredentialsChainVerboseErrors: aws.Bool(true),
 	})
 	if err != nil {
-		return "", err
+		log.Fatalln("failed to create session:", err)
 	}
-	return esu.ParseARN(*resp.TaskDefinition.TaskDefinitionArn).ShortName(), nil
-}
 
-func loadCurrentTaskDefinitions(svc *ecs.ECS, tasks []esu.TaskInfo) ([]*ecs.TaskDefinition, error) {
-	defs := make([]*ecs.TaskDefinition, len(tasks))
-	for i, t := range tasks {
-		resp, err := svc.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
-			TaskDefinition: aws.String(t.TaskDefinition),
-		})
-		if err != nil {
-			return nil, err
+	d := esu.NewDeployer(sess, *cluster)
+	d.StateDir = *stateDir
+	d.LockHolder = *lockHolder
+	d.LockLease = *lockLease
+	if *lockTable != "" {
+		d.Locks = esu.NewConditionalLockStore(esu.NewDynamoDBStore(sess, *lockTable))
+	} else if *lockDir != "" {
+		d.Locks = esu.NewFileLockStore(*lockDir)
+	}
+	d.OnProgress = func(e esu.DeployEvent) {
+		log.Println(e.Message)
+		for _, task := range e.Tasks {
+			log.Println("  ", task)
 		}
-		defs[i] = resp.TaskDefinition
 	}
-	return defs, nil
-}
 
-func getLatestTaskDef(svc *ecs.ECS, family string) (*ecs.TaskDefinition, error) {
-	list, err := svc.ListTaskDefinitions(&ecs.ListTaskDefinitionsInput{
-		FamilyPrefix: aws.String(family),
-		MaxResults:   aws.Int64(1),
-		Sort:         aws.String("DESC"),
-	})
-	if err != nil {
-		return nil, err
-	}
-	if len(list.TaskDefinitionArns) == 0 {
-		return nil, fmt.Errorf("not task definitions available")
+	req := esu.DeployRequest{
+		Service: *service,
+		Family:  taskDef,
+		Tag:     *tag,
+		Images:  containerImages,
+		Force:   *force,
+		Timeout: *timeout,
+
+		MaxStoppedTasks: *maxStopped,
+		BreakLock:       *breakLock,
 	}
-	desc, err := svc.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
-		TaskDefinition: list.TaskDefinitionArns[0],
-	})
-	if err != nil {
-		return nil, err
+	if *canary {
+		req.Strategy = esu.StrategyCanary
+		req.Canary = &esu.CanaryConfig{Count: *canaryCount, BakeTime: *bake}
+		if *probe != "" {
+			req.Canary.Probe = esu.HTTPProbe(nil, *probe)
+		}
 	}
-	return desc.TaskDefinition, nil
-}
-
-// checkTask returns true if all tasks belong to the given taskDef (family:revision).
-func checkTask(tasks []esu.TaskInfo, taskDef string) bool {
-	for _, t := range tasks {
-		if t.TaskDefinition != taskDef {
-			return false
+	if *standby != "" {
+		req.Strategy = esu.StrategyBlueGreen
+		req.BlueGreen = &esu.BlueGreenConfig{Standby: *standby, Drain: *drain}
+		if *switchURL != "" {
+			req.BlueGreen.Switch = esu.HTTPTrafficSwitch(nil, *switchURL)
+		} else if *switchFile != "" {
+			req.BlueGreen.Switch = esu.FileTrafficSwitch(*switchFile)
 		}
 	}
-	return true
-}
 
-// checkTag returns true if all tasks are using the provided tagged image.
-func checkTag(defs []*ecs.TaskDefinition, tag string) bool {
-	for i, d := range defs {
-		if len(d.ContainerDefinitions) != 1 {
-			log.Fatalln("Multi-container tasks are not currently supported!")
-		}
-		t := esu.ParseARN(*d.ContainerDefinitions[0].Image)
-		log.Printf("Task %d at revision %d, running %s", i, *d.Revision, t.ShortName())
-		if t.Revision != tag {
-			return false
+	if *plan {
+		p, err := d.Plan(context.Background(), req)
+		if err != nil {
+			log.Fatalln("Failed to plan deploy:", err)
 		}
+		fmt.Print(p)
+		return
 	}
-	return true
-}
 
-// checkFamily returns true if all tasks have the right task definitoon.
-func checkFamily(defs []*ecs.TaskDefinition, taskDef string) bool {
-	for _, d := range defs {
-		if *d.Family != taskDef {
-			return false
-		}
+	// Stop the deploy on ctrl+c or SIGTERM, leaving canaries in place to be
+	// resumed and releasing the deploy lock.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Println("Interrupted, stopping deploy")
+		cancel()
+	}()
+
+	if _, err := d.Deploy(ctx, req); err != nil {
+		log.Println("Failure:", err)
+		os.Exit(1)
 	}
-	return true
+
+	log.Println("Success!")
 }
 
-// isStable returns true if all task definitions are for the same revision.
-func isStable(defs []*ecs.TaskDefinition) bool {
-	var r int64
-	for _, d := range defs {
-		if r == 0 {
-			r = *d.Revision
-		} else if r != *d.Revision {
-			return false
-		}
+// defaultStateDir returns a directory in the user's cache directory for canary
+// progress, so interrupted deploys can be resumed without --state-dir.
+func defaultStateDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
 	}
-	return true
+	return filepath.Join(dir, "esu")
 }
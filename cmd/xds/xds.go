@@ -0,0 +1,67 @@
+// Envoy control plane serving EDS cluster membership for ECS services.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dpup/esu"
+	"github.com/dpup/esu/cmd/internal/naming"
+	"github.com/dpup/esu/xds"
+)
+
+var (
+	region   = flag.String("region", "us-east-1", "Which EC2 region to use")
+	cluster  = flag.String("cluster", "", "Cluster the services run on")
+	services = flag.String("services", "", "Comma separated list of services to serve as EDS clusters")
+	addr     = flag.String("addr", ":18000", "Address to serve xDS on")
+)
+
+func main() {
+	flag.Parse()
+
+	var err error
+	if *cluster, err = naming.Cluster(*cluster); err != nil {
+		log.Fatalln("failed to resolve cluster:", err)
+	}
+
+	if *cluster == "" || *services == "" {
+		log.Fatalln("--cluster (or --env) and --services are required")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:                        region,
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	})
+	if err != nil {
+		log.Fatalln("failed to create session:", err)
+	}
+
+	s := xds.New()
+	s.OnError = func(err error) {
+		log.Println("snapshot error:", err)
+	}
+	for _, service := range strings.Split(*services, ",") {
+		service := strings.TrimSpace(service)
+		tm := esu.NewTaskMonitor(sess, *cluster, service)
+		tm.OnTaskChange = func(tasks []esu.TaskInfo) {
+			log.Printf("%s: %d running tasks", service, len(tasks))
+		}
+		tm.OnError = func(err error) {
+			log.Printf("%s: error: %s", service, err)
+		}
+		s.AddService(service, tm)
+		tm.Monitor()
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalln("failed to listen:", err)
+	}
+	log.Printf("Serving EDS on %s", *addr)
+	log.Fatalln(s.Serve(l))
+}
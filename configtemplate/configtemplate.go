@@ -0,0 +1,249 @@
+// Package configtemplate renders text/template files using the running tasks of
+// ECS services, for generating upstream configs for HAProxy, nginx and the
+// like. Output is written atomically and a reload command is run only when the
+// rendered output changes.
+//
+// Templates are passed a Data value, along with a "service" function that
+// returns the running tasks for a named service:
+//
+//	upstream website {
+//	{{- range service "website"}}
+//	  server {{.PrivateIPAddress}}:{{.Port}};
+//	{{- end}}
+//	}
+package configtemplate
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/dpup/esu"
+)
+
+// DefaultDebounce is how long task changes must settle before templates are
+// rendered, so a rolling deploy doesn't trigger a reload for every task.
+const DefaultDebounce = 5 * time.Second
+
+// DefaultMaxWait is the longest rendering is delayed by a stream of changes.
+const DefaultMaxWait = time.Minute
+
+// DefaultRetryInterval is how long to wait before rendering again after a
+// failure.
+const DefaultRetryInterval = 30 * time.Second
+
+// Template describes a template file and where its output should go.
+type Template struct {
+	// Source is the path of the text/template file.
+	Source string
+	// Dest is the path the rendered output is written to.
+	Dest string
+	// Command, if set, is run with "sh -c" after Dest changes. If it fails,
+	// the previous Dest is restored so the retried render sees the change.
+	Command string
+	// Perms are the permissions of Dest, defaults to 0644.
+	Perms os.FileMode
+}
+
+// Data is passed to templates when they are executed.
+type Data struct {
+	// Services maps service names to their running tasks.
+	Services map[string][]esu.TaskInfo
+}
+
+// Renderer watches services and re-renders templates when their tasks change.
+type Renderer struct {
+	Templates     []*Template
+	Debounce      time.Duration
+	MaxWait       time.Duration
+	RetryInterval time.Duration
+
+	// OnRender is called after a template's output has changed and been
+	// written, with the output of the reload command if there was one.
+	OnRender func(t *Template, cmdOutput []byte)
+	OnError  func(error)
+
+	// renderMu serializes renders, so the initial render and a timer can't
+	// write and reload at the same time.
+	renderMu sync.Mutex
+
+	mu       sync.Mutex
+	monitors map[string]*esu.TaskMonitor
+	timer    *time.Timer
+	pending  time.Time
+}
+
+// New returns a renderer for the given templates.
+func New(templates ...*Template) *Renderer {
+	return &Renderer{
+		Templates:     templates,
+		Debounce:      DefaultDebounce,
+		MaxWait:       DefaultMaxWait,
+		RetryInterval: DefaultRetryInterval,
+		monitors:      map[string]*esu.TaskMonitor{},
+	}
+}
+
+// AddService makes a service's tasks available to templates. Changes to the
+// service's running tasks trigger a debounced render. The caller is
+// responsible for starting the monitor.
+func (r *Renderer) AddService(tm *esu.TaskMonitor) {
+	r.mu.Lock()
+	r.monitors[tm.Service] = tm
+	r.mu.Unlock()
+	tm.AddTaskListener(func([]esu.TaskInfo) { r.Trigger() })
+}
+
+// Trigger schedules a render once changes have settled for Debounce, or at
+// most MaxWait after the first unrendered change.
+func (r *Renderer) Trigger() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.pending.IsZero() {
+		r.pending = now
+	}
+	wait := r.Debounce
+	if deadline := r.pending.Add(r.MaxWait); now.Add(wait).After(deadline) {
+		wait = deadline.Sub(now)
+	}
+	r.schedule(wait)
+}
+
+// schedule replaces any pending render with one after wait. Must be called
+// with the lock held.
+func (r *Renderer) schedule(wait time.Duration) {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		r.mu.Lock()
+		if r.timer != timer {
+			// Replaced by a later Trigger after firing.
+			r.mu.Unlock()
+			return
+		}
+		r.pending = time.Time{}
+		r.timer = nil
+		r.mu.Unlock()
+		if err := r.Render(); err != nil && r.OnError != nil {
+			r.OnError(err)
+		}
+	})
+	r.timer = timer
+}
+
+// Render renders every template immediately, writing and reloading those whose
+// output has changed. The first error encountered is returned, but all
+// templates are attempted. Nothing is rendered until every service's monitor
+// has successfully listed its tasks.
+//
+// If rendering fails, it is retried after RetryInterval unless a render is
+// already pending.
+func (r *Renderer) Render() error {
+	r.renderMu.Lock()
+	defer r.renderMu.Unlock()
+	data, err := r.data()
+	if err != nil {
+		r.retry()
+		return err
+	}
+	var first error
+	for _, t := range r.Templates {
+		if err := r.render(t, data); err != nil {
+			err = fmt.Errorf("%s: %s", t.Source, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil {
+		r.retry()
+	}
+	return first
+}
+
+// retry schedules another render after RetryInterval, unless one is pending.
+func (r *Renderer) retry() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer == nil && r.RetryInterval > 0 {
+		r.schedule(r.RetryInterval)
+	}
+}
+
+func (r *Renderer) render(t *Template, data *Data) error {
+	src, err := ioutil.ReadFile(t.Source)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(t.Source).Funcs(template.FuncMap{
+		"service": func(name string) []esu.TaskInfo { return data.Services[name] },
+	}).Parse(string(src))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	existing, err := ioutil.ReadFile(t.Dest)
+	if err == nil && bytes.Equal(existing, buf.Bytes()) {
+		return nil
+	}
+	hadExisting := err == nil
+	perms := t.Perms
+	if perms == 0 {
+		perms = 0644
+	}
+	if err := esu.WriteFileAtomic(t.Dest, buf.Bytes(), perms); err != nil {
+		return err
+	}
+
+	var out []byte
+	if t.Command != "" {
+		out, err = exec.Command("sh", "-c", t.Command).CombinedOutput()
+		if err != nil {
+			// Put back the previous output, so the next render sees a change
+			// and retries the reload.
+			if hadExisting {
+				esu.WriteFileAtomic(t.Dest, existing, perms)
+			} else {
+				os.Remove(t.Dest)
+			}
+			return fmt.Errorf("reload command failed: %s: %s", err, out)
+		}
+	}
+	if r.OnRender != nil {
+		r.OnRender(t, out)
+	}
+	return nil
+}
+
+// data snapshots the running tasks of every service. Tasks are sorted by
+// address so output is stable. An error is returned if a service's tasks have
+// never been listed, rather than rendering it with no tasks.
+func (r *Renderer) data() (*Data, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := &Data{Services: map[string][]esu.TaskInfo{}}
+	for name, tm := range r.monitors {
+		if tm.LastSuccessfulUpdate().IsZero() {
+			return nil, fmt.Errorf("tasks for %s have not been listed yet", name)
+		}
+		tasks := append([]esu.TaskInfo{}, tm.RunningTasks()...)
+		sort.Slice(tasks, func(i, j int) bool {
+			return tasks[i].PrivateAddress() < tasks[j].PrivateAddress()
+		})
+		d.Services[name] = tasks
+	}
+	return d, nil
+}
@@ -0,0 +1,223 @@
+package configtemplate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpup/esu"
+)
+
+type fakeLister struct {
+	tasks []esu.TaskInfo
+}
+
+func (f *fakeLister) Tasks(service string) ([]esu.TaskInfo, error) {
+	return f.tasks, nil
+}
+
+func task(ip string, port int) esu.TaskInfo {
+	return esu.TaskInfo{
+		DesiredStatus:    esu.ECSTaskStatusRunning,
+		LastStatus:       esu.ECSTaskStatusRunning,
+		EC2InstanceID:    "i-" + ip,
+		PrivateIPAddress: ip,
+		Port:             port,
+	}
+}
+
+const upstreamTemplate = `upstream website {
+{{- range service "website"}}
+  server {{.PrivateIPAddress}}:{{.Port}};
+{{- end}}
+}
+`
+
+func setup(t *testing.T) (string, *Template, *fakeLister, *esu.TaskMonitor) {
+	dir, err := ioutil.TempDir("", "configtemplate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "upstream.tmpl")
+	if err := ioutil.WriteFile(src, []byte(upstreamTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &Template{
+		Source:  src,
+		Dest:    filepath.Join(dir, "upstream.conf"),
+		Command: "echo reload >> " + filepath.Join(dir, "reloads"),
+	}
+	lister := &fakeLister{tasks: []esu.TaskInfo{task("10.0.0.2", 8080), task("10.0.0.1", 8080)}}
+	return dir, tmpl, lister, esu.NewTaskMonitorWithLister(lister, "website")
+}
+
+func reloads(t *testing.T, dir string) int {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "reloads"))
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(b), "reload")
+}
+
+func TestRenderOnlyReloadsOnChange(t *testing.T) {
+	dir, tmpl, lister, tm := setup(t)
+	defer os.RemoveAll(dir)
+	r := New(tmpl)
+	r.AddService(tm)
+	tm.Update()
+
+	if err := r.Render(); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadFile(tmpl.Dest)
+	expected := "upstream website {\n  server 10.0.0.1:8080;\n  server 10.0.0.2:8080;\n}\n"
+	if string(out) != expected {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if n := reloads(t, dir); n != 1 {
+		t.Errorf("expected 1 reload, got %d", n)
+	}
+
+	// Unchanged output doesn't reload.
+	if err := r.Render(); err != nil {
+		t.Fatal(err)
+	}
+	if n := reloads(t, dir); n != 1 {
+		t.Errorf("expected no reload for unchanged output, got %d", n)
+	}
+
+	lister.tasks = lister.tasks[:1]
+	tm.Update()
+	if err := r.Render(); err != nil {
+		t.Fatal(err)
+	}
+	if n := reloads(t, dir); n != 2 {
+		t.Errorf("expected reload for changed output, got %d", n)
+	}
+}
+
+func TestRenderRetriesFailedReload(t *testing.T) {
+	dir, tmpl, _, tm := setup(t)
+	defer os.RemoveAll(dir)
+	ok := filepath.Join(dir, "ok")
+	tmpl.Command = "test -f " + ok + " && " + tmpl.Command
+	r := New(tmpl)
+	r.RetryInterval = 0
+	r.AddService(tm)
+	tm.Update()
+
+	if err := r.Render(); err == nil {
+		t.Fatal("expected reload to fail")
+	}
+	if _, err := os.Stat(tmpl.Dest); !os.IsNotExist(err) {
+		t.Errorf("expected output to be removed after a failed reload, got %v", err)
+	}
+
+	// The same output is written and reloaded again once the command works.
+	ioutil.WriteFile(ok, nil, 0644)
+	if err := r.Render(); err != nil {
+		t.Fatal(err)
+	}
+	if n := reloads(t, dir); n != 1 {
+		t.Errorf("expected failed reload to be retried, got %d reloads", n)
+	}
+}
+
+func TestRenderRetriesAfterFailure(t *testing.T) {
+	dir, tmpl, _, tm := setup(t)
+	defer os.RemoveAll(dir)
+	ok := filepath.Join(dir, "ok")
+	tmpl.Command = "test -f " + ok + " && " + tmpl.Command
+	r := New(tmpl)
+	r.RetryInterval = 20 * time.Millisecond
+	rendered := make(chan bool, 1)
+	r.OnRender = func(*Template, []byte) { rendered <- true }
+	tm.Update()
+	r.AddService(tm)
+
+	if err := r.Render(); err == nil {
+		t.Fatal("expected reload to fail")
+	}
+	ioutil.WriteFile(ok, nil, 0644)
+	select {
+	case <-rendered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected failed reload to be retried")
+	}
+	if n := reloads(t, dir); n != 1 {
+		t.Errorf("expected 1 reload after retrying, got %d", n)
+	}
+}
+
+func TestRenderWaitsForServices(t *testing.T) {
+	dir, tmpl, _, tm := setup(t)
+	defer os.RemoveAll(dir)
+	r := New(tmpl)
+	r.RetryInterval = 0
+	r.AddService(tm)
+
+	if err := r.Render(); err == nil {
+		t.Error("expected error rendering before tasks have been listed")
+	}
+	if _, err := os.Stat(tmpl.Dest); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written before tasks have been listed, got %v", err)
+	}
+	if n := reloads(t, dir); n != 0 {
+		t.Errorf("expected no reloads before tasks have been listed, got %d", n)
+	}
+	tm.Update()
+	if err := r.Render(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	dir, tmpl, lister, tm := setup(t)
+	defer os.RemoveAll(dir)
+	r := New(tmpl)
+	r.Debounce = 50 * time.Millisecond
+	rendered := make(chan bool, 10)
+	r.OnRender = func(*Template, []byte) { rendered <- true }
+	r.AddService(tm)
+
+	// Simulate a rolling deploy replacing tasks one at a time.
+	for i := 0; i < 5; i++ {
+		lister.tasks = append([]esu.TaskInfo{}, lister.tasks...)
+		lister.tasks[i%2] = task("10.0.1."+string(rune('1'+i)), 8080)
+		tm.Update()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-rendered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for render")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := reloads(t, dir); n != 1 {
+		t.Errorf("expected changes to be debounced into 1 reload, got %d", n)
+	}
+}
+
+func TestMaxWait(t *testing.T) {
+	dir, tmpl, _, tm := setup(t)
+	defer os.RemoveAll(dir)
+	r := New(tmpl)
+	r.Debounce = time.Hour
+	r.MaxWait = 50 * time.Millisecond
+	rendered := make(chan bool, 1)
+	r.OnRender = func(*Template, []byte) { rendered <- true }
+	r.AddService(tm)
+	tm.Update()
+
+	select {
+	case <-rendered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected MaxWait to force a render")
+	}
+}
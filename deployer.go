@@ -0,0 +1,860 @@
+package esu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+// DefaultDeployTimeout is how long a deploy waits for tasks to update before
+// rolling back.
+const DefaultDeployTimeout = 2 * time.Minute
+
+// DefaultMaxStoppedTasks is how many tasks of a new revision may stop before a
+// deploy is considered to be crash looping.
+const DefaultMaxStoppedTasks = 2
+
+// DefaultDeployPollFreq is how often a deploy checks whether tasks have
+// updated.
+const DefaultDeployPollFreq = 5 * time.Second
+
+var (
+	// ErrDeployTimeout is returned when a service's deployment doesn't complete
+	// within the deploy timeout.
+	ErrDeployTimeout = errors.New("timed out waiting for deployment to complete")
+
+	// ErrUnstable is returned when a service is running multiple revisions and
+	// the deploy isn't forced.
+	ErrUnstable = errors.New("tasks aren't stable, multiple revisions active")
+)
+
+// DeployStage identifies the step a deploy is on when reporting progress.
+type DeployStage string
+
+// Stages reported by the deployer.
+const (
+	DeployStageCheck    DeployStage = "check"
+	DeployStageRegister DeployStage = "register"
+	DeployStageUpdate   DeployStage = "update"
+	DeployStageWait     DeployStage = "wait"
+	DeployStageCanary   DeployStage = "canary"
+	DeployStageBake     DeployStage = "bake"
+	DeployStagePromote  DeployStage = "promote"
+	DeployStageSwitch   DeployStage = "switch"
+	DeployStageDrain    DeployStage = "drain"
+	DeployStageRollback DeployStage = "rollback"
+	DeployStageDone     DeployStage = "done"
+)
+
+// DeployStrategy is how a new revision is rolled out to a service.
+type DeployStrategy string
+
+// Strategies supported by the deployer.
+const (
+	// StrategyRolling updates the service in place, letting ECS replace its
+	// tasks. This is the default.
+	StrategyRolling DeployStrategy = "rolling"
+
+	// StrategyCanary first runs the new revision in a separate canary service,
+	// and only updates the service once the canary has baked.
+	StrategyCanary DeployStrategy = "canary"
+
+	// StrategyBlueGreen deploys the new revision to a standby service, and
+	// switches traffic to it once all its tasks are healthy, so that only one
+	// revision ever takes traffic.
+	StrategyBlueGreen DeployStrategy = "bluegreen"
+)
+
+// DeployRequest describes a deploy of new images to a service. At least one of
+// Tag or Images must be set.
+type DeployRequest struct {
+	Service string
+
+	// Family is the task definition family used as a template for the new
+	// revision. Defaults to the service name.
+	Family string
+
+	// Tag of the new image to deploy to the canonical container, the only
+	// container or the one named after the service.
+	Tag string
+
+	// Images maps container names to the full image reference to deploy, for
+	// example {"worker": "worker:v2"}. Containers that aren't listed keep
+	// their current image.
+	Images map[string]string
+
+	// Force deploys even if the service is running multiple revisions.
+	Force bool
+
+	// Timeout is how long to wait for tasks to update before rolling back.
+	// Defaults to DefaultDeployTimeout.
+	Timeout time.Duration
+
+	// MaxStoppedTasks is how many tasks of the new revision may stop before
+	// the deploy fails and is rolled back, without waiting for the timeout.
+	// Defaults to DefaultMaxStoppedTasks, negative values disable the check.
+	MaxStoppedTasks int
+
+	// Strategy used to roll out the new revision. Defaults to StrategyRolling.
+	Strategy DeployStrategy
+
+	// Canary configures StrategyCanary.
+	Canary *CanaryConfig
+
+	// BlueGreen configures StrategyBlueGreen, which requires its Standby.
+	BlueGreen *BlueGreenConfig
+
+	// BreakLock takes the service's deploy lock even if another deploy holds
+	// it.
+	BreakLock bool
+}
+
+// DeployResult describes the outcome of a deploy.
+type DeployResult struct {
+	// Previous is the revision the service was using, and the rollback
+	// target.
+	Previous TaskDefinitionID
+
+	// Deployed is the newly registered revision.
+	Deployed TaskDefinitionID
+
+	// UpToDate is true if all tasks were already running the requested
+	// images, so nothing was deployed.
+	UpToDate bool
+
+	// RolledBack is true if the service was reverted to Previous.
+	RolledBack bool
+
+	Duration time.Duration
+}
+
+// DeployEvent reports the progress of a deploy.
+type DeployEvent struct {
+	Service     string
+	Stage       DeployStage
+	Message     string
+	Tasks       []TaskInfo
+	Deployments []DeploymentState
+	Time        time.Time
+}
+
+func (e DeployEvent) String() string {
+	return fmt.Sprintf("[%s] %s", e.Stage, e.Message)
+}
+
+// Deployer registers new task definition revisions and rolls services onto
+// them, reverting if the tasks don't update in time.
+type Deployer struct {
+	Cluster  string
+	PollFreq time.Duration
+
+	// OnProgress is called as a deploy moves through its stages.
+	OnProgress func(DeployEvent)
+
+	// StateDir, if set, is where the progress of canary deploys is saved, so
+	// that an interrupted deploy resumes where it left off.
+	StateDir string
+
+	// Locks, if set, stops concurrent deploys of the same service. Deploys
+	// fail with a LockHeldError while another deploy holds the lock.
+	Locks LockStore
+
+	// LockHolder describes who is deploying. Defaults to DefaultLockHolder.
+	LockHolder string
+
+	// LockLease is how long a lock is held without being renewed. Defaults to
+	// DefaultLockLease.
+	LockLease time.Duration
+
+	ecs   ecsiface.ECSAPI
+	tasks TaskLister
+	now   func() time.Time
+}
+
+// NewDeployer returns a deployer for services on the given cluster.
+func NewDeployer(sess *session.Session, cluster string) *Deployer {
+	return newDeployer(ecs.New(sess), NewTaskFinder(sess, cluster), cluster)
+}
+
+func newDeployer(svc ecsiface.ECSAPI, tasks TaskLister, cluster string) *Deployer {
+	return &Deployer{
+		Cluster:  cluster,
+		PollFreq: DefaultDeployPollFreq,
+		ecs:      svc,
+		tasks:    tasks,
+		now:      time.Now,
+	}
+}
+
+// DeployPlan describes what a deploy would do, without changing anything.
+type DeployPlan struct {
+	Request DeployRequest
+
+	// Current is the task definition the service is currently using.
+	Current TaskDefinitionID
+
+	// Template is the latest revision of the family, which the new revision is
+	// based on.
+	Template TaskDefinitionID
+
+	// Images to deploy, keyed by container name.
+	Images map[string]string
+
+	// UpToDate is true if all tasks are already running the requested images.
+	UpToDate bool
+
+	// Unstable is true if the service is running multiple revisions, which
+	// prevents a deploy unless forced.
+	Unstable bool
+
+	// Changes from the current task definition to the new one.
+	Changes []TaskDefinitionChange
+
+	// Replaced are the tasks that would be replaced by the deploy.
+	Replaced []TaskInfo
+
+	// Live is the service whose tasks are replaced. For blue/green deploys the
+	// new revision is deployed to Standby, and Live is then scaled down.
+	Live    string
+	Standby string
+
+	// Input that would register the new revision.
+	Input *ecs.RegisterTaskDefinitionInput
+}
+
+func (p *DeployPlan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plan for %s:\n", p.Request.Service)
+	fmt.Fprintf(&b, "  Current:  %s\n", orNone(p.Current.String()))
+	fmt.Fprintf(&b, "  Template: %s\n", p.Template)
+	if p.Standby != "" {
+		fmt.Fprintf(&b, "  Live:     %s, deploying to %s\n", p.Live, p.Standby)
+	}
+	if p.UpToDate {
+		fmt.Fprintf(&b, "  All tasks are up to date\n")
+		return b.String()
+	}
+	if p.Unstable {
+		fmt.Fprintf(&b, "  Tasks aren't stable, multiple revisions active\n")
+	}
+	fmt.Fprintf(&b, "  Changes:\n")
+	for _, c := range p.Changes {
+		fmt.Fprintf(&b, "    %s\n", c)
+	}
+	if len(p.Changes) == 0 {
+		fmt.Fprintf(&b, "    (none)\n")
+	}
+	fmt.Fprintf(&b, "  Tasks to be replaced:\n")
+	for _, t := range p.Replaced {
+		fmt.Fprintf(&b, "    %s\n", t)
+	}
+	if len(p.Replaced) == 0 {
+		fmt.Fprintf(&b, "    (none)\n")
+	}
+	return b.String()
+}
+
+// Plan computes the new revision a deploy would register, and how it differs
+// from the task definition the service is currently using, without
+// registering it or updating the service.
+func (d *Deployer) Plan(ctx context.Context, req DeployRequest) (*DeployPlan, error) {
+	plan, _, err := d.plan(ctx, req)
+	return plan, err
+}
+
+// Deploy registers a new revision of the request's task definition family
+// using the requested images, and updates the service to use it. If ECS
+// reports the rollout as failed, too many new tasks stop, or the rollout
+// doesn't complete within the timeout, the service is rolled back and a
+// RolloutFailedError, CrashLoopError or ErrDeployTimeout returned.
+//
+// With StrategyCanary the new revision is first run in a canary service, and
+// the service is only updated if the canary stays healthy while it bakes.
+//
+// If the deployer has a lock store, the service's deploy lock is held
+// throughout.
+func (d *Deployer) Deploy(ctx context.Context, req DeployRequest) (*DeployResult, error) {
+	if d.Locks == nil {
+		return d.deploy(ctx, req, nil)
+	}
+	// The deploy is cancelled if the lock is lost.
+	deployCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lease, err := d.lock(deployCtx, req, cancel)
+	if err != nil {
+		return nil, err
+	}
+	result, err := d.deploy(deployCtx, req, lease)
+	if rerr := lease.release(ctx); rerr != nil && (err == nil || lease.lost()) {
+		err = rerr
+	}
+	return result, err
+}
+
+func (d *Deployer) deploy(ctx context.Context, req DeployRequest, lease *deployLease) (*DeployResult, error) {
+	start := time.Now()
+	plan, defs, err := d.plan(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	req = plan.Request
+	result := &DeployResult{Previous: plan.Template}
+	if !plan.Current.IsZero() {
+		result.Previous = plan.Current
+	}
+
+	if req.Strategy == StrategyCanary {
+		state, err := d.loadCanaryState(req.Service)
+		if err != nil {
+			return nil, propagate(err, "failed to load canary state")
+		}
+		if state != nil {
+			if err := d.checkCanaryState(ctx, plan, state); err != nil {
+				return nil, err
+			}
+			d.progress(req, DeployStageCanary, nil, "Resuming canary deploy of %s at %s", state.TaskDefinition, state.Stage)
+			result.Previous, result.Deployed = state.Previous, state.TaskDefinition
+			return d.finish(req, result, start, d.canary(ctx, req, result, state))
+		}
+	}
+
+	for i, def := range defs {
+		d.progress(req, DeployStageCheck, nil, "Task %d at revision %d, running %s",
+			i, aws.Int64Value(def.Revision), describeImages(def))
+	}
+	for _, name := range sortedKeys(plan.Images) {
+		d.progress(req, DeployStageCheck, nil, "Container %s: %s -> %s",
+			name, strings.Join(currentImages(defs, name), ", "), plan.Images[name])
+	}
+	if plan.UpToDate {
+		result.UpToDate = true
+		result.Duration = time.Since(start)
+		d.progress(req, DeployStageDone, plan.Replaced, "All tasks are up to date")
+		return result, nil
+	} else if plan.Unstable {
+		d.progress(req, DeployStageCheck, plan.Replaced, "Tasks aren't stable, multiple revisions active")
+		if !req.Force {
+			return nil, ErrUnstable
+		}
+	} else if len(plan.Replaced) == 0 {
+		d.progress(req, DeployStageCheck, nil, "No tasks currently running")
+	}
+
+	d.progress(req, DeployStageRegister, nil, "Using %s as template", plan.Template)
+	if result.Deployed, err = d.registerRevision(ctx, plan.Input); err != nil {
+		return nil, propagate(err, "failed to register task definition")
+	}
+	d.progress(req, DeployStageRegister, nil, "Registered %s", result.Deployed)
+	if lease != nil {
+		if err := lease.record(ctx, result.Deployed); err != nil {
+			return nil, propagate(err, "failed to renew deploy lock")
+		}
+	}
+
+	switch req.Strategy {
+	case StrategyCanary:
+		err = d.canary(ctx, req, result, nil)
+	case StrategyBlueGreen:
+		err = d.blueGreen(ctx, req, result, plan)
+	default:
+		err = d.rollingUpdate(ctx, req, result)
+	}
+	return d.finish(req, result, start, err)
+}
+
+func (d *Deployer) finish(req DeployRequest, result *DeployResult, start time.Time, err error) (*DeployResult, error) {
+	result.Duration = time.Since(start)
+	if err == nil {
+		d.progress(req, DeployStageDone, nil, "Deployed %s in %.fs", result.Deployed, result.Duration.Seconds())
+	}
+	return result, err
+}
+
+// plan fills in the request's defaults and computes the deploy. It also
+// returns the task definitions of the service's tasks.
+func (d *Deployer) plan(ctx context.Context, req DeployRequest) (*DeployPlan, []*ecs.TaskDefinition, error) {
+	if req.Family == "" {
+		req.Family = req.Service
+	}
+	if req.Timeout == 0 {
+		req.Timeout = DefaultDeployTimeout
+	}
+	if req.MaxStoppedTasks == 0 {
+		req.MaxStoppedTasks = DefaultMaxStoppedTasks
+	}
+	switch req.Strategy {
+	case "":
+		req.Strategy = StrategyRolling
+	case StrategyRolling:
+	case StrategyCanary:
+		cfg := CanaryConfig{}
+		if req.Canary != nil {
+			cfg = *req.Canary
+		}
+		if cfg.Service == "" {
+			cfg.Service = req.Service + DefaultCanarySuffix
+		}
+		if cfg.Count == 0 {
+			cfg.Count = 1
+		}
+		if cfg.BakeTime == 0 {
+			cfg.BakeTime = DefaultCanaryBakeTime
+		}
+		req.Canary = &cfg
+	case StrategyBlueGreen:
+		if req.BlueGreen == nil || req.BlueGreen.Standby == "" || req.BlueGreen.Standby == req.Service {
+			return nil, nil, errors.New("blue/green deploys require a standby service")
+		}
+		cfg := *req.BlueGreen
+		if cfg.Drain == 0 {
+			cfg.Drain = DefaultBlueGreenDrain
+		}
+		req.BlueGreen = &cfg
+	default:
+		return nil, nil, fmt.Errorf("unknown deploy strategy %q", req.Strategy)
+	}
+	plan := &DeployPlan{Request: req}
+
+	// Use most recent task definition as a template for the service update.
+	template, err := d.latestTaskDefinition(ctx, req.Family)
+	if err != nil {
+		return nil, nil, propagate(err, "failed to fetch task definition")
+	}
+	if plan.Template, err = ParseTaskDefinitionID(aws.StringValue(template.TaskDefinition.TaskDefinitionArn)); err != nil {
+		return nil, nil, err
+	}
+	if plan.Images, err = targetImages(template.TaskDefinition, req); err != nil {
+		return nil, nil, err
+	}
+	plan.Input = CloneTaskDefinition(template.TaskDefinition, template.Tags)
+	for _, c := range plan.Input.ContainerDefinitions {
+		if image, ok := plan.Images[aws.StringValue(c.Name)]; ok {
+			c.Image = aws.String(image)
+		}
+	}
+
+	plan.Live = req.Service
+	if req.Strategy == StrategyBlueGreen {
+		if plan.Live, plan.Standby, err = d.blueGreenServices(ctx, req); err != nil {
+			return nil, nil, propagate(err, "failed to describe services")
+		}
+	}
+	if plan.Replaced, err = d.tasks.Tasks(plan.Live); err != nil {
+		return nil, nil, propagate(err, "failed to query tasks")
+	}
+	defs, err := d.currentTaskDefinitions(ctx, plan.Replaced)
+	if err != nil {
+		return nil, nil, propagate(err, "failed to query task definition")
+	}
+	if len(defs) > 0 {
+		plan.UpToDate = checkFamily(defs, req.Family) && checkImages(defs, plan.Images)
+		plan.Unstable = !isStable(defs)
+	}
+
+	// Diff against the service's task definition, which may differ from the
+	// template if a newer revision was registered but not deployed.
+	current := template
+	svc, err := d.describeService(ctx, plan.Live)
+	if err != nil {
+		return nil, nil, propagate(err, "failed to describe service")
+	}
+	if plan.Current, err = ParseTaskDefinitionID(aws.StringValue(svc.TaskDefinition)); err != nil {
+		return nil, nil, err
+	}
+	if plan.Current != plan.Template {
+		if current, err = d.ecs.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: svc.TaskDefinition,
+		}); err != nil {
+			return nil, nil, propagate(err, "failed to query task definition")
+		}
+	}
+	plan.Changes = DiffTaskDefinitions(CloneTaskDefinition(current.TaskDefinition, nil), plan.Input)
+	if plan.UpToDate {
+		plan.Replaced = nil
+	}
+	return plan, defs, nil
+}
+
+// rollingUpdate updates the request's service to the deployed revision,
+// rolling back to the previous revision if the rollout fails.
+func (d *Deployer) rollingUpdate(ctx context.Context, req DeployRequest, result *DeployResult) error {
+	err := d.updateService(ctx, req, req.Service, result.Deployed)
+	if isRolloutFailure(err) {
+		d.progress(req, DeployStageRollback, nil, "Rolling back to %s", result.Previous)
+		if rerr := d.updateService(ctx, req, req.Service, result.Previous); rerr != nil {
+			err = fmt.Errorf("%s, rollback failed: %s", err, rerr)
+		} else {
+			result.RolledBack = true
+		}
+	}
+	return err
+}
+
+// isRolloutFailure returns true for errors that mean a revision is bad and
+// should be rolled back.
+func isRolloutFailure(err error) bool {
+	var failed *RolloutFailedError
+	var crashing *CrashLoopError
+	return err == ErrDeployTimeout || errors.As(err, &failed) || errors.As(err, &crashing)
+}
+
+// updateService points a service at a task definition and waits for ECS to
+// report its deployment complete, with the desired count of tasks running.
+func (d *Deployer) updateService(ctx context.Context, req DeployRequest, service string, taskDef TaskDefinitionID) error {
+	resp, err := d.ecs.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{
+		Cluster:        aws.String(d.Cluster),
+		Service:        aws.String(service),
+		TaskDefinition: aws.String(taskDef.String()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update service %s/%s -> %s: %s", d.Cluster, service, taskDef, err)
+	}
+	d.progress(req, DeployStageUpdate, nil, "Service %s updated to %s", service, aws.StringValue(resp.Service.TaskDefinition))
+	return d.waitForRollout(ctx, req, resp.Service, taskDef)
+}
+
+// waitForRollout waits for ECS to report a service's deployment of a task
+// definition complete. svc is the service's state when the deployment started.
+func (d *Deployer) waitForRollout(ctx context.Context, req DeployRequest, svc *ecs.Service, taskDef TaskDefinitionID) error {
+	service := aws.StringValue(svc.ServiceName)
+
+	// Only report events that happen after the update.
+	events := eventTracker{}
+	events.unseen(svc.Events)
+	stopped := map[string]StoppedTask{}
+
+	start := time.Now()
+	// Tasks created before the update, such as those it replaced, aren't
+	// counted as failures of the new deployment.
+	since := deploymentCreated(svc, taskDef)
+	if since.IsZero() {
+		since = start
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.PollFreq):
+		}
+
+		svc, err := d.describeService(ctx, service)
+		if err != nil {
+			// Ignore errors while waiting for the update.
+			d.progress(req, DeployStageWait, nil, "Failed to describe service: %s", err)
+			continue
+		}
+		for _, msg := range events.unseen(svc.Events) {
+			d.progress(req, DeployStageWait, nil, "Event: %s", msg)
+		}
+		states, err := deploymentStates(svc)
+		if err != nil {
+			return err
+		}
+		if err := d.checkStopped(ctx, req, service, taskDef, since, time.Time{}, stopped); err != nil {
+			d.progressDeployments(req, states, "Deployment failed: %s", err)
+			return err
+		}
+
+		wait := time.Since(start)
+		done, err := rolloutStatus(states, taskDef)
+		if err != nil {
+			d.progressDeployments(req, states, "Deployment failed: %s", err)
+			return err
+		} else if done {
+			d.progressDeployments(req, states, "Deployment complete (%.fs)", wait.Seconds())
+			return nil
+		} else if wait > req.Timeout {
+			d.progressDeployments(req, states, "Timed out waiting for deployment")
+			return ErrDeployTimeout
+		}
+		d.progressDeployments(req, states, "Waiting... (%.fs) %s", wait.Seconds(), describeDeployments(states))
+	}
+}
+
+// checkStopped reports a service's tasks of a task definition that have
+// stopped since the last check, and returns a CrashLoopError once more than the
+// request allows have stopped. Tasks stopped by users, created before
+// createdSince or stopped before stoppedSince aren't counted.
+func (d *Deployer) checkStopped(ctx context.Context, req DeployRequest, service string, taskDef TaskDefinitionID, createdSince, stoppedSince time.Time, stopped map[string]StoppedTask) error {
+	if req.MaxStoppedTasks < 0 {
+		return nil
+	}
+	tasks, err := d.stoppedTasks(ctx, service)
+	if err != nil {
+		// Ignore errors while waiting for the update.
+		d.progress(req, DeployStageWait, nil, "Failed to query stopped tasks: %s", err)
+		return nil
+	}
+	for _, t := range tasks {
+		if _, ok := stopped[t.TaskARN]; ok || t.TaskDefinition != taskDef || t.StopCode == ecs.TaskStopCodeUserInitiated {
+			continue
+		}
+		if !t.CreatedAt.IsZero() && t.CreatedAt.Before(createdSince) {
+			continue
+		}
+		if !t.StoppedAt.IsZero() && t.StoppedAt.Before(stoppedSince) {
+			continue
+		}
+		stopped[t.TaskARN] = t
+		d.progress(req, DeployStageWait, nil, "Task stopped: %s", t)
+	}
+	if len(stopped) <= req.MaxStoppedTasks {
+		return nil
+	}
+	crashErr := &CrashLoopError{TaskDefinition: taskDef}
+	for _, t := range stopped {
+		crashErr.Stopped = append(crashErr.Stopped, t)
+	}
+	sort.Slice(crashErr.Stopped, func(i, j int) bool {
+		return crashErr.Stopped[i].StoppedAt.Before(crashErr.Stopped[j].StoppedAt)
+	})
+	return crashErr
+}
+
+// stoppedTasks returns the service's recently stopped tasks.
+func (d *Deployer) stoppedTasks(ctx context.Context, service string) ([]StoppedTask, error) {
+	in := &ecs.ListTasksInput{
+		Cluster:       aws.String(d.Cluster),
+		ServiceName:   aws.String(service),
+		DesiredStatus: aws.String(string(ECSTaskStatusStopped)),
+	}
+	var taskArns []*string
+	for {
+		list, err := d.ecs.ListTasksWithContext(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		taskArns = append(taskArns, list.TaskArns...)
+		if list.NextToken == nil {
+			break
+		}
+		in.NextToken = list.NextToken
+	}
+	stopped := []StoppedTask{}
+	for _, arns := range chunk(taskArns, 100) {
+		resp, err := d.ecs.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(d.Cluster),
+			Tasks:   arns,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range resp.Tasks {
+			st, err := newStoppedTask(t)
+			if err != nil {
+				return nil, err
+			}
+			stopped = append(stopped, st)
+		}
+	}
+	return stopped, nil
+}
+
+func (d *Deployer) describeService(ctx context.Context, service string) (*ecs.Service, error) {
+	resp, err := d.ecs.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{
+		Cluster:  aws.String(d.Cluster),
+		Services: []*string{aws.String(service)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Failures) > 0 {
+		return nil, fmt.Errorf("%s: %s", aws.StringValue(resp.Failures[0].Arn), aws.StringValue(resp.Failures[0].Reason))
+	} else if len(resp.Services) == 0 {
+		return nil, fmt.Errorf("service %s not found", service)
+	}
+	return resp.Services[0], nil
+}
+
+// registerRevision registers a new task definition revision.
+func (d *Deployer) registerRevision(ctx context.Context, in *ecs.RegisterTaskDefinitionInput) (TaskDefinitionID, error) {
+	resp, err := d.ecs.RegisterTaskDefinitionWithContext(ctx, in)
+	if err != nil {
+		return TaskDefinitionID{}, err
+	}
+	return ParseTaskDefinitionID(aws.StringValue(resp.TaskDefinition.TaskDefinitionArn))
+}
+
+func (d *Deployer) currentTaskDefinitions(ctx context.Context, tasks []TaskInfo) ([]*ecs.TaskDefinition, error) {
+	defs := make([]*ecs.TaskDefinition, len(tasks))
+	for i, t := range tasks {
+		resp, err := d.ecs.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: aws.String(t.TaskDefinition.String()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		defs[i] = resp.TaskDefinition
+	}
+	return defs, nil
+}
+
+// latestTaskDefinition returns the most recent revision of a family, along with
+// its tags.
+func (d *Deployer) latestTaskDefinition(ctx context.Context, family string) (*ecs.DescribeTaskDefinitionOutput, error) {
+	list, err := d.ecs.ListTaskDefinitionsWithContext(ctx, &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: aws.String(family),
+		MaxResults:   aws.Int64(1),
+		Sort:         aws.String(ecs.SortOrderDesc),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(list.TaskDefinitionArns) == 0 {
+		return nil, fmt.Errorf("no task definitions available for %s", family)
+	}
+	return d.ecs.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: list.TaskDefinitionArns[0],
+		Include:        []*string{aws.String(ecs.TaskDefinitionFieldTags)},
+	})
+}
+
+func (d *Deployer) progress(req DeployRequest, stage DeployStage, tasks []TaskInfo, format string, args ...interface{}) {
+	d.emit(req, DeployEvent{Stage: stage, Message: fmt.Sprintf(format, args...), Tasks: tasks})
+}
+
+func (d *Deployer) progressDeployments(req DeployRequest, states []DeploymentState, format string, args ...interface{}) {
+	d.emit(req, DeployEvent{Stage: DeployStageWait, Message: fmt.Sprintf(format, args...), Deployments: states})
+}
+
+func (d *Deployer) emit(req DeployRequest, e DeployEvent) {
+	if d.OnProgress != nil {
+		e.Service = req.Service
+		e.Time = time.Now()
+		d.OnProgress(e)
+	}
+}
+
+// checkImages returns true if all tasks are running the given images, keyed by
+// container name.
+func checkImages(defs []*ecs.TaskDefinition, images map[string]string) bool {
+	for _, d := range defs {
+		for name, image := range images {
+			c := findContainer(d, name)
+			if c == nil || aws.StringValue(c.Image) != image {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// targetImages returns the images a request deploys, keyed by container name.
+func targetImages(template *ecs.TaskDefinition, req DeployRequest) (map[string]string, error) {
+	if req.Tag == "" && len(req.Images) == 0 {
+		return nil, errors.New("no images to deploy")
+	}
+	images := map[string]string{}
+	for name, image := range req.Images {
+		if findContainer(template, name) == nil {
+			return nil, fmt.Errorf("no container named %q in %s", name, aws.StringValue(template.Family))
+		}
+		ref, err := ParseImageRef(image)
+		if err != nil {
+			return nil, err
+		}
+		images[name] = ref.String()
+	}
+	if req.Tag != "" {
+		c, err := canonicalContainer(template, req.Service)
+		if err != nil {
+			return nil, err
+		}
+		name := aws.StringValue(c.Name)
+		if _, ok := images[name]; ok {
+			return nil, fmt.Errorf("image for container %q specified twice", name)
+		}
+		ref, err := ParseImageRef(aws.StringValue(c.Image))
+		if err != nil {
+			return nil, err
+		}
+		images[name] = ref.WithTag(req.Tag).String()
+	}
+	return images, nil
+}
+
+// canonicalContainer returns the only container in a task definition, or for
+// multi-container tasks the container named after the service.
+func canonicalContainer(def *ecs.TaskDefinition, service string) (*ecs.ContainerDefinition, error) {
+	if len(def.ContainerDefinitions) == 1 {
+		return def.ContainerDefinitions[0], nil
+	}
+	if c := findContainer(def, service); c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf("ambiguous, multi-container task, one container should match service name")
+}
+
+func findContainer(def *ecs.TaskDefinition, name string) *ecs.ContainerDefinition {
+	for _, c := range def.ContainerDefinitions {
+		if aws.StringValue(c.Name) == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// currentImages returns the distinct images a container is running across
+// task definitions.
+func currentImages(defs []*ecs.TaskDefinition, name string) []string {
+	seen := map[string]bool{}
+	images := []string{}
+	for _, d := range defs {
+		if c := findContainer(d, name); c != nil && !seen[aws.StringValue(c.Image)] {
+			seen[aws.StringValue(c.Image)] = true
+			images = append(images, aws.StringValue(c.Image))
+		}
+	}
+	if len(images) == 0 {
+		images = append(images, "(none)")
+	}
+	return images
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkFamily returns true if all tasks have the right task definition.
+func checkFamily(defs []*ecs.TaskDefinition, family string) bool {
+	for _, d := range defs {
+		if aws.StringValue(d.Family) != family {
+			return false
+		}
+	}
+	return true
+}
+
+// isStable returns true if all task definitions are for the same revision.
+func isStable(defs []*ecs.TaskDefinition) bool {
+	var r int64
+	for _, d := range defs {
+		if r == 0 {
+			r = *d.Revision
+		} else if r != *d.Revision {
+			return false
+		}
+	}
+	return true
+}
+
+func describeImages(def *ecs.TaskDefinition) string {
+	images := make([]string, len(def.ContainerDefinitions))
+	for i, c := range def.ContainerDefinitions {
+		images[i] = aws.StringValue(c.Image)
+	}
+	return strings.Join(images, ", ")
+}
@@ -0,0 +1,571 @@
+package esu
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+// fakeECS stores task definitions and services in memory. Updating a service
+// immediately completes the rollout, moving all its tasks onto the new
+// revision, unless rollout has a different state for the task definition.
+type fakeECS struct {
+	ecsiface.ECSAPI
+
+	mu         sync.Mutex
+	defs       []*ecs.TaskDefinition
+	registered []*ecs.RegisterTaskDefinitionInput
+	services   map[string]*ecs.Service
+	tasks      map[string][]TaskInfo
+	rollout    map[string]string
+	stopped    []*ecs.Task
+	updates    map[string][]string
+	deleted    []string
+}
+
+func newFakeECS(image string) *fakeECS {
+	f := &fakeECS{
+		services: map[string]*ecs.Service{},
+		tasks:    map[string][]TaskInfo{},
+		rollout:  map[string]string{},
+		updates:  map[string][]string{},
+	}
+	f.defs = append(f.defs, &ecs.TaskDefinition{
+		Family:      aws.String("website"),
+		Revision:    aws.Int64(1),
+		NetworkMode: aws.String(ecs.NetworkModeAwsvpc),
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{Name: aws.String("website"), Image: aws.String(image)},
+		},
+	})
+	f.defs[0].TaskDefinitionArn = aws.String(taskDefARN("website", 1))
+	f.addService("website", "website:1", 2)
+	return f
+}
+
+func (f *fakeECS) addService(name, taskDef string, count int64) {
+	f.services[name] = &ecs.Service{
+		ServiceName:    aws.String(name),
+		Status:         aws.String("ACTIVE"),
+		TaskDefinition: aws.String(taskDef),
+		DesiredCount:   aws.Int64(count),
+		Deployments:    []*ecs.Deployment{deployment("PRIMARY", taskDef, ecs.DeploymentRolloutStateCompleted, count, count)},
+		Events:         []*ecs.ServiceEvent{{Id: aws.String(name + "-e0"), Message: aws.String("(service " + name + ") has reached a steady state.")}},
+	}
+	id, _ := ParseTaskDefinitionID(taskDef)
+	f.setTasks(name, id, int(count))
+}
+
+func deployment(status, taskDef, rollout string, desired, running int64) *ecs.Deployment {
+	return &ecs.Deployment{
+		Id:             aws.String("ecs-svc/" + taskDef),
+		Status:         aws.String(status),
+		TaskDefinition: aws.String(taskDef),
+		DesiredCount:   aws.Int64(desired),
+		RunningCount:   aws.Int64(running),
+		PendingCount:   aws.Int64(desired - running),
+		RolloutState:   aws.String(rollout),
+		CreatedAt:      aws.Time(time.Now()),
+	}
+}
+
+func taskDefARN(family string, revision int) string {
+	return fmt.Sprintf("arn:aws:ecs:us-east-1:12345678:task-definition/%s:%d", family, revision)
+}
+
+func (f *fakeECS) setTasks(service string, id TaskDefinitionID, count int) {
+	tasks := make([]TaskInfo, count)
+	for i := range tasks {
+		tasks[i] = runningTask(fmt.Sprintf("10.0.%d.%d", len(service), i+1), 8080)
+		tasks[i].TaskARN = fmt.Sprintf("arn:aws:ecs:us-east-1:12345678:task/sites/%s-%d", service, i)
+		tasks[i].TaskDefinition = id
+	}
+	f.tasks[service] = tasks
+}
+
+// Tasks implements TaskLister.
+func (f *fakeECS) Tasks(service string) ([]TaskInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tasks[service], nil
+}
+
+func (f *fakeECS) find(name string) *ecs.TaskDefinition {
+	id, _ := ParseTaskDefinitionID(name)
+	for _, d := range f.defs {
+		if *d.Family == id.Family && int(*d.Revision) == id.Revision {
+			return d
+		}
+	}
+	return nil
+}
+
+func (f *fakeECS) ListTaskDefinitionsWithContext(ctx aws.Context, in *ecs.ListTaskDefinitionsInput, opts ...request.Option) (*ecs.ListTaskDefinitionsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &ecs.ListTaskDefinitionsOutput{}
+	for i := len(f.defs) - 1; i >= 0; i-- {
+		if *f.defs[i].Family == *in.FamilyPrefix {
+			out.TaskDefinitionArns = append(out.TaskDefinitionArns, f.defs[i].TaskDefinitionArn)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeECS) DescribeTaskDefinitionWithContext(ctx aws.Context, in *ecs.DescribeTaskDefinitionInput, opts ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.find(*in.TaskDefinition)
+	if d == nil {
+		return nil, fmt.Errorf("unknown task definition %s", *in.TaskDefinition)
+	}
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: d}, nil
+}
+
+func (f *fakeECS) RegisterTaskDefinitionWithContext(ctx aws.Context, in *ecs.RegisterTaskDefinitionInput, opts ...request.Option) (*ecs.RegisterTaskDefinitionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.registered = append(f.registered, in)
+	rev := len(f.defs) + 1
+	d := &ecs.TaskDefinition{
+		TaskDefinitionArn:    aws.String(taskDefARN(*in.Family, rev)),
+		Family:               in.Family,
+		Revision:             aws.Int64(int64(rev)),
+		ContainerDefinitions: in.ContainerDefinitions,
+		TaskRoleArn:          in.TaskRoleArn,
+		NetworkMode:          in.NetworkMode,
+	}
+	f.defs = append(f.defs, d)
+	return &ecs.RegisterTaskDefinitionOutput{TaskDefinition: d}, nil
+}
+
+func (f *fakeECS) UpdateServiceWithContext(ctx aws.Context, in *ecs.UpdateServiceInput, opts ...request.Option) (*ecs.UpdateServiceOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	svc, ok := f.services[*in.Service]
+	if !ok {
+		return nil, fmt.Errorf("ServiceNotFoundException: %s", *in.Service)
+	}
+	if in.DesiredCount != nil {
+		svc.DesiredCount = in.DesiredCount
+	}
+	taskDef := aws.StringValue(svc.TaskDefinition)
+	if in.TaskDefinition != nil {
+		taskDef = *in.TaskDefinition
+		f.updates[*in.Service] = append(f.updates[*in.Service], taskDef)
+	}
+	f.rolloutService(svc, taskDef)
+	return &ecs.UpdateServiceOutput{Service: svc}, nil
+}
+
+func (f *fakeECS) rolloutService(svc *ecs.Service, taskDef string) {
+	state := f.rollout[taskDef]
+	if state == "" {
+		state = ecs.DeploymentRolloutStateCompleted
+	}
+	name, count := *svc.ServiceName, *svc.DesiredCount
+	prev := svc.Deployments[0]
+	svc.TaskDefinition = aws.String(taskDef)
+	if state == ecs.DeploymentRolloutStateCompleted {
+		id, _ := ParseTaskDefinitionID(taskDef)
+		f.setTasks(name, id, int(count))
+		svc.Deployments = []*ecs.Deployment{deployment("PRIMARY", taskDef, state, count, count)}
+	} else {
+		prev.Status = aws.String("ACTIVE")
+		svc.Deployments = []*ecs.Deployment{deployment("PRIMARY", taskDef, state, count, 0), prev}
+	}
+	svc.Events = append([]*ecs.ServiceEvent{{
+		Id:      aws.String(fmt.Sprintf("%s-e%d", name, len(svc.Events))),
+		Message: aws.String("(service " + name + ") updated to " + taskDef),
+	}}, svc.Events...)
+}
+
+func (f *fakeECS) CreateServiceWithContext(ctx aws.Context, in *ecs.CreateServiceInput, opts ...request.Option) (*ecs.CreateServiceOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if svc, ok := f.services[*in.ServiceName]; ok && *svc.Status == "ACTIVE" {
+		return nil, fmt.Errorf("InvalidParameterException: Creation of service was not idempotent")
+	}
+	svc := &ecs.Service{
+		ServiceName:          in.ServiceName,
+		Status:               aws.String("ACTIVE"),
+		DesiredCount:         in.DesiredCount,
+		LaunchType:           in.LaunchType,
+		NetworkConfiguration: in.NetworkConfiguration,
+		LoadBalancers:        in.LoadBalancers,
+		ServiceRegistries:    in.ServiceRegistries,
+		RoleArn:              in.Role,
+		Deployments:          []*ecs.Deployment{{}},
+	}
+	f.services[*in.ServiceName] = svc
+	f.updates[*in.ServiceName] = append(f.updates[*in.ServiceName], *in.TaskDefinition)
+	f.rolloutService(svc, *in.TaskDefinition)
+	return &ecs.CreateServiceOutput{Service: svc}, nil
+}
+
+func (f *fakeECS) DeleteServiceWithContext(ctx aws.Context, in *ecs.DeleteServiceInput, opts ...request.Option) (*ecs.DeleteServiceOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	svc, ok := f.services[*in.Service]
+	if !ok {
+		return nil, fmt.Errorf("ServiceNotFoundException: %s", *in.Service)
+	}
+	svc.Status = aws.String("INACTIVE")
+	delete(f.tasks, *in.Service)
+	f.deleted = append(f.deleted, *in.Service)
+	return &ecs.DeleteServiceOutput{Service: svc}, nil
+}
+
+func (f *fakeECS) ListTasksWithContext(ctx aws.Context, in *ecs.ListTasksInput, opts ...request.Option) (*ecs.ListTasksOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var arns []*string
+	for _, t := range f.stopped {
+		if aws.StringValue(t.Group) == "service:"+*in.ServiceName {
+			arns = append(arns, t.TaskArn)
+		}
+	}
+	// Return pages of two tasks.
+	start, _ := strconv.Atoi(aws.StringValue(in.NextToken))
+	out := &ecs.ListTasksOutput{}
+	if start+2 < len(arns) {
+		out.TaskArns = arns[start : start+2]
+		out.NextToken = aws.String(strconv.Itoa(start + 2))
+	} else if start < len(arns) {
+		out.TaskArns = arns[start:]
+	}
+	return out, nil
+}
+
+func (f *fakeECS) DescribeTasksWithContext(ctx aws.Context, in *ecs.DescribeTasksInput, opts ...request.Option) (*ecs.DescribeTasksOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &ecs.DescribeTasksOutput{}
+	for _, arn := range in.Tasks {
+		for _, t := range f.stopped {
+			if *t.TaskArn == *arn {
+				out.Tasks = append(out.Tasks, t)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeECS) DescribeServicesWithContext(ctx aws.Context, in *ecs.DescribeServicesInput, opts ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &ecs.DescribeServicesOutput{}
+	for _, name := range in.Services {
+		if svc, ok := f.services[*name]; ok {
+			out.Services = append(out.Services, svc)
+		} else {
+			out.Failures = append(out.Failures, &ecs.Failure{Arn: name, Reason: aws.String("MISSING")})
+		}
+	}
+	return out, nil
+}
+
+func testDeployer(f *fakeECS) (*Deployer, *[]DeployEvent) {
+	d := newDeployer(f, f, "sites")
+	d.PollFreq = time.Millisecond
+	events := &[]DeployEvent{}
+	d.OnProgress = func(e DeployEvent) { *events = append(*events, e) }
+	return d, events
+}
+
+func TestDeploy(t *testing.T) {
+	f := newFakeECS("12345678.dkr.ecr.us-east-1.amazonaws.com/website:v1")
+	d, events := testDeployer(f)
+
+	result, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Previous.String() != "website:1" || result.Deployed.String() != "website:2" || result.RolledBack {
+		t.Errorf("unexpected result: %#v", result)
+	}
+	if image := *f.defs[1].ContainerDefinitions[0].Image; image != "12345678.dkr.ecr.us-east-1.amazonaws.com/website:v2" {
+		t.Errorf("unexpected image %s", image)
+	}
+	if *f.defs[0].ContainerDefinitions[0].Image != "12345678.dkr.ecr.us-east-1.amazonaws.com/website:v1" {
+		t.Errorf("template was modified")
+	}
+	if mode := aws.StringValue(f.registered[0].NetworkMode); mode != ecs.NetworkModeAwsvpc {
+		t.Errorf("network mode was not preserved, was %q", mode)
+	}
+	if last := (*events)[len(*events)-1]; last.Stage != DeployStageDone {
+		t.Errorf("last event was %s", last)
+	}
+
+	// Deploying the same tag again is a no-op.
+	result, err = d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2"})
+	if err != nil || !result.UpToDate {
+		t.Errorf("expected up to date, was %#v %v", result, err)
+	}
+	if len(f.updates["website"]) != 1 {
+		t.Errorf("unexpected updates: %v", f.updates)
+	}
+}
+
+func TestDeployRollback(t *testing.T) {
+	f := newFakeECS("website:v1")
+	f.rollout["website:2"] = ecs.DeploymentRolloutStateInProgress
+	d, _ := testDeployer(f)
+
+	result, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2", Timeout: 5 * time.Millisecond})
+	if err != ErrDeployTimeout {
+		t.Errorf("expected timeout, was %v", err)
+	}
+	if !result.RolledBack {
+		t.Errorf("expected rollback: %#v", result)
+	}
+	if fmt.Sprint(f.updates["website"]) != "[website:2 website:1]" {
+		t.Errorf("unexpected updates: %v", f.updates)
+	}
+
+	// Rollback goes to the service's revision, not a newer undeployed one.
+	f = newFakeECS("website:v1")
+	f.RegisterTaskDefinitionWithContext(context.Background(), &ecs.RegisterTaskDefinitionInput{
+		Family:               aws.String("website"),
+		ContainerDefinitions: f.defs[0].ContainerDefinitions,
+	})
+	f.rollout["website:3"] = ecs.DeploymentRolloutStateInProgress
+	d, _ = testDeployer(f)
+	result, err = d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2", Timeout: 5 * time.Millisecond})
+	if err != ErrDeployTimeout || result.Previous.String() != "website:1" {
+		t.Errorf("expected timeout rolling back to website:1, was %#v %v", result, err)
+	}
+	if fmt.Sprint(f.updates["website"]) != "[website:3 website:1]" {
+		t.Errorf("unexpected updates: %v", f.updates)
+	}
+}
+
+func TestDeployUnstable(t *testing.T) {
+	f := newFakeECS("website:v1")
+	f.RegisterTaskDefinitionWithContext(context.Background(), &ecs.RegisterTaskDefinitionInput{
+		Family:               aws.String("website"),
+		ContainerDefinitions: f.defs[0].ContainerDefinitions,
+	})
+	f.tasks["website"][1].TaskDefinition = TaskDefinitionID{"website", 2}
+	d, _ := testDeployer(f)
+
+	if _, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2"}); err != ErrUnstable {
+		t.Errorf("expected ErrUnstable, was %v", err)
+	}
+	if _, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2", Force: true}); err != nil {
+		t.Errorf("forced deploy failed: %v", err)
+	}
+}
+
+func TestDeployMultiContainer(t *testing.T) {
+	f := newFakeECS("website:v1")
+	f.defs[0].ContainerDefinitions = append(f.defs[0].ContainerDefinitions,
+		&ecs.ContainerDefinition{Name: aws.String("worker"), Image: aws.String("registry:5000/worker:v1")},
+		&ecs.ContainerDefinition{Name: aws.String("logger"), Image: aws.String("fluentd:v1")},
+	)
+	d, events := testDeployer(f)
+
+	_, err := d.Deploy(context.Background(), DeployRequest{
+		Service: "website",
+		Tag:     "v2",
+		Images:  map[string]string{"worker": "registry:5000/worker:v3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := []string{}
+	for _, c := range f.registered[0].ContainerDefinitions {
+		images = append(images, *c.Name+"="+*c.Image)
+	}
+	if s := fmt.Sprint(images); s != "[website=website:v2 worker=registry:5000/worker:v3 logger=fluentd:v1]" {
+		t.Errorf("unexpected images %s", s)
+	}
+	reported := []string{}
+	for _, e := range *events {
+		if strings.HasPrefix(e.Message, "Container ") {
+			reported = append(reported, e.Message)
+		}
+	}
+	if s := strings.Join(reported, "\n"); s != "Container website: website:v1 -> website:v2\n"+
+		"Container worker: registry:5000/worker:v1 -> registry:5000/worker:v3" {
+		t.Errorf("unexpected report:\n%s", s)
+	}
+
+	invalid := []DeployRequest{
+		{Service: "website"},
+		{Service: "other", Family: "website", Tag: "v2"},
+		{Service: "website", Images: map[string]string{"missing": "app:v2"}},
+		{Service: "website", Images: map[string]string{"worker": "Bad:Image"}},
+		{Service: "website", Tag: "v2", Images: map[string]string{"website": "website:v3"}},
+	}
+	for _, req := range invalid {
+		if _, err := d.Deploy(context.Background(), req); err == nil {
+			t.Errorf("expected error deploying %#v", req)
+		}
+	}
+}
+
+func TestDeployRolloutFailed(t *testing.T) {
+	f := newFakeECS("website:v1")
+	f.rollout["website:2"] = ecs.DeploymentRolloutStateFailed
+	d, events := testDeployer(f)
+
+	result, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2"})
+	if _, ok := err.(*RolloutFailedError); !ok {
+		t.Errorf("expected RolloutFailedError, was %v", err)
+	}
+	if !result.RolledBack || fmt.Sprint(f.updates["website"]) != "[website:2 website:1]" {
+		t.Errorf("expected rollback: %#v %v", result, f.updates)
+	}
+	var reported []string
+	for _, e := range *events {
+		if strings.HasPrefix(e.Message, "Event: ") {
+			reported = append(reported, e.Message)
+		}
+	}
+	if len(reported) != 0 {
+		t.Errorf("events before the update shouldn't be reported: %v", reported)
+	}
+}
+
+func TestRolloutStatus(t *testing.T) {
+	taskDef := TaskDefinitionID{"website", 2}
+	cases := []struct {
+		deployments []*ecs.Deployment
+		done        bool
+		err         bool
+	}{
+		{[]*ecs.Deployment{deployment("PRIMARY", "website:2", "COMPLETED", 2, 2)}, true, false},
+		{[]*ecs.Deployment{deployment("PRIMARY", "website:2", "", 2, 2)}, true, false},
+		{[]*ecs.Deployment{deployment("PRIMARY", "website:2", "", 2, 1)}, false, false},
+		{[]*ecs.Deployment{deployment("PRIMARY", "website:2", "IN_PROGRESS", 2, 2)}, false, false},
+		{[]*ecs.Deployment{deployment("ACTIVE", "website:1", "", 2, 2), deployment("PRIMARY", "website:2", "", 2, 2)}, false, false},
+		{[]*ecs.Deployment{deployment("PRIMARY", "website:2", "FAILED", 2, 0)}, false, true},
+		{[]*ecs.Deployment{deployment("PRIMARY", "website:3", "COMPLETED", 2, 2)}, false, true},
+	}
+	for i, c := range cases {
+		states, err := deploymentStates(&ecs.Service{Deployments: c.deployments})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done, err := rolloutStatus(states, taskDef)
+		if done != c.done || (err != nil) != c.err {
+			t.Errorf("%d: %s was done=%v err=%v", i, describeDeployments(states), done, err)
+		}
+	}
+}
+
+func crashedTask(i int) *ecs.Task {
+	return &ecs.Task{
+		TaskArn:           aws.String(fmt.Sprintf("arn:aws:ecs:us-east-1:12345678:task/sites/task%d", i)),
+		Group:             aws.String("service:website"),
+		TaskDefinitionArn: aws.String(taskDefARN("website", 2)),
+		StopCode:          aws.String(ecs.TaskStopCodeEssentialContainerExited),
+		StoppedReason:     aws.String("Essential container in task exited"),
+		StoppedAt:         aws.Time(time.Unix(int64(1000+i), 0)),
+		Containers: []*ecs.Container{
+			{Name: aws.String("website"), ExitCode: aws.Int64(137), Reason: aws.String("OutOfMemoryError")},
+		},
+	}
+}
+
+func TestDeployCrashLoop(t *testing.T) {
+	f := newFakeECS("website:v1")
+	f.rollout["website:2"] = ecs.DeploymentRolloutStateInProgress
+	f.stopped = []*ecs.Task{crashedTask(2), crashedTask(0), crashedTask(1),
+		// Tasks of other revisions, or stopped by users, aren't counted.
+		{TaskArn: aws.String("arn:aws:ecs:us-east-1:12345678:task/sites/old"), Group: aws.String("service:website"), TaskDefinitionArn: aws.String(taskDefARN("website", 1))},
+		{TaskArn: aws.String("arn:aws:ecs:us-east-1:12345678:task/sites/user"), Group: aws.String("service:website"), TaskDefinitionArn: aws.String(taskDefARN("website", 2)),
+			StopCode: aws.String(ecs.TaskStopCodeUserInitiated)},
+	}
+	d, _ := testDeployer(f)
+
+	start := time.Now()
+	result, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2", Timeout: time.Minute})
+	crashErr, ok := err.(*CrashLoopError)
+	if !ok {
+		t.Fatalf("expected CrashLoopError, was %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("deploy didn't fail fast")
+	}
+	if len(crashErr.Stopped) != 3 || crashErr.Stopped[0].String() != "task0 Essential container in task exited, website exited 137 (OutOfMemoryError)" {
+		t.Errorf("unexpected diagnosis: %s", err)
+	}
+	if !result.RolledBack {
+		t.Errorf("expected rollback: %#v", result)
+	}
+
+	// Tasks replaced by the deploy don't stop it being rolled back.
+	f = newFakeECS("website:v1")
+	f.addService("website", "website:1", 3)
+	f.rollout["website:2"] = ecs.DeploymentRolloutStateInProgress
+	f.stopped = []*ecs.Task{crashedTask(0), crashedTask(1), crashedTask(2)}
+	for i := 0; i < 3; i++ {
+		f.stopped = append(f.stopped, &ecs.Task{
+			TaskArn:           aws.String(fmt.Sprintf("arn:aws:ecs:us-east-1:12345678:task/sites/old%d", i)),
+			Group:             aws.String("service:website"),
+			TaskDefinitionArn: aws.String(taskDefARN("website", 1)),
+			StopCode:          aws.String("ServiceSchedulerInitiated"),
+			CreatedAt:         aws.Time(time.Now().Add(-time.Hour)),
+		})
+	}
+	d, _ = testDeployer(f)
+	result, err = d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2", Timeout: time.Minute})
+	if _, ok := err.(*CrashLoopError); !ok || !result.RolledBack {
+		t.Errorf("expected crash loop to be rolled back, was %#v %v", result, err)
+	}
+	if fmt.Sprint(f.updates["website"]) != "[website:2 website:1]" {
+		t.Errorf("unexpected updates: %v", f.updates)
+	}
+
+	// Up to the limit of stopped tasks is tolerated.
+	f = newFakeECS("website:v1")
+	f.stopped = []*ecs.Task{crashedTask(0), crashedTask(1), crashedTask(2)}
+	d, _ = testDeployer(f)
+	if _, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2", MaxStoppedTasks: 3}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	f := newFakeECS("website:v1")
+	// A newer revision that was registered but never deployed.
+	f.RegisterTaskDefinitionWithContext(context.Background(), &ecs.RegisterTaskDefinitionInput{
+		Family: aws.String("website"),
+		ContainerDefinitions: []*ecs.ContainerDefinition{{
+			Name:        aws.String("website"),
+			Image:       aws.String("website:v1"),
+			Environment: []*ecs.KeyValuePair{{Name: aws.String("DEBUG"), Value: aws.String("1")}},
+		}},
+	})
+	f.registered = nil
+	d, _ := testDeployer(f)
+
+	plan, err := d.Plan(context.Background(), DeployRequest{Service: "website", Tag: "v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Current.String() != "website:1" || plan.Template.String() != "website:2" || plan.UpToDate {
+		t.Errorf("unexpected plan: %s", plan)
+	}
+	changes := fmt.Sprint(plan.Changes)
+	if changes != "[network mode: awsvpc -> (none) website image: website:v1 -> website:v2 website env DEBUG: (none) -> 1]" {
+		t.Errorf("unexpected changes: %s", changes)
+	}
+	if len(plan.Replaced) != 2 {
+		t.Errorf("expected 2 tasks to be replaced: %v", plan.Replaced)
+	}
+	if len(f.registered) != 0 || len(f.updates) != 0 {
+		t.Errorf("plan shouldn't change anything: %v %v", f.registered, f.updates)
+	}
+}
@@ -0,0 +1,381 @@
+package esu
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// DefaultLockLease is how long a deploy lock is held without being renewed.
+// Deploys renew their lock while they run, so this only matters if a deployer
+// dies without releasing it.
+const DefaultLockLease = 10 * time.Minute
+
+// ErrConditionFailed is returned by a ConditionalStore when a write's condition
+// doesn't hold.
+var ErrConditionFailed = errors.New("condition failed")
+
+// DeployLock records who is deploying a service.
+type DeployLock struct {
+	// Key identifies the service, as "<cluster>/<service>".
+	Key string
+
+	// ID is unique to each deploy, so a holder can tell its lock apart from
+	// one taken by the same holder elsewhere.
+	ID string
+
+	// Holder describes who is deploying, e.g. "alice@laptop".
+	Holder string
+
+	Started time.Time
+	Expires time.Time
+
+	// TaskDefinition is the revision being deployed, once registered.
+	TaskDefinition TaskDefinitionID
+}
+
+func (l DeployLock) String() string {
+	str := fmt.Sprintf("%s locked by %s since %s", l.Key, l.Holder, l.Started.Format(time.RFC3339))
+	if !l.TaskDefinition.IsZero() {
+		str += fmt.Sprintf(", deploying %s", l.TaskDefinition)
+	}
+	return str + fmt.Sprintf(" (expires %s)", l.Expires.Format(time.RFC3339))
+}
+
+// LockHeldError is returned when a service's deploy lock is held by another
+// deploy.
+type LockHeldError struct {
+	Lock DeployLock
+}
+
+func (e *LockHeldError) Error() string {
+	return "deploy in progress, " + e.Lock.String()
+}
+
+// LockStore stores deploy locks. Implementations must make Acquire atomic, so
+// only one deploy can hold a key's lock.
+type LockStore interface {
+	// Acquire stores lock if its key isn't locked, the current lock has
+	// expired or has the same ID, or force is true. Otherwise it returns a
+	// LockHeldError describing the current lock.
+	Acquire(ctx context.Context, lock DeployLock, force bool) error
+
+	// Release removes the lock for lock's key, if it has lock's ID.
+	Release(ctx context.Context, lock DeployLock) error
+}
+
+// checkLock returns a LockHeldError if current prevents lock from being
+// acquired.
+func checkLock(current *DeployLock, lock DeployLock, force bool, now time.Time) error {
+	if current == nil || force || current.ID == lock.ID || now.After(current.Expires) {
+		return nil
+	}
+	return &LockHeldError{Lock: *current}
+}
+
+// DefaultLockHolder describes the current user and host, as "user@host".
+func DefaultLockHolder() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return name + "@" + host
+}
+
+func newLockID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// deployLease holds a deploy lock, renewing it in the background until
+// released. If the lock is lost, the deploy is cancelled.
+type deployLease struct {
+	store  LockStore
+	lease  time.Duration
+	now    func() time.Time
+	cancel context.CancelFunc
+	done   chan struct{}
+	retry  chan struct{}
+
+	mu   sync.Mutex
+	lock DeployLock
+	err  error
+
+	// taskDef is the revision to record in the lock on the next renewal.
+	taskDef TaskDefinitionID
+
+	// released is set once the lock has been released, after which renewals
+	// do nothing so a heartbeat can't recreate the lock.
+	released bool
+}
+
+// lock acquires the lock on a request's service, and keeps renewing it until
+// the returned lease is released. cancel is called if the lock is lost.
+func (d *Deployer) lock(ctx context.Context, req DeployRequest, cancel context.CancelFunc) (*deployLease, error) {
+	holder := d.LockHolder
+	if holder == "" {
+		holder = DefaultLockHolder()
+	}
+	lease := d.LockLease
+	if lease == 0 {
+		lease = DefaultLockLease
+	}
+	now := d.now()
+	l := &deployLease{
+		store:  d.Locks,
+		lease:  lease,
+		now:    d.now,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		retry:  make(chan struct{}, 1),
+		lock: DeployLock{
+			Key:     d.Cluster + "/" + req.Service,
+			ID:      newLockID(),
+			Holder:  holder,
+			Started: now,
+			Expires: now.Add(lease),
+		},
+	}
+	err := l.store.Acquire(ctx, l.lock, false)
+	var held *LockHeldError
+	if errors.As(err, &held) && req.BreakLock {
+		d.progress(req, DeployStageCheck, nil, "Breaking deploy lock: %s", held.Lock)
+		err = l.store.Acquire(ctx, l.lock, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.progress(req, DeployStageCheck, nil, "Acquired deploy lock on %s", l.lock.Key)
+	go l.heartbeat()
+	return l, nil
+}
+
+// heartbeat renews the lease until it's released or lost. Failed renewals
+// are retried sooner, until the lease expires.
+func (l *deployLease) heartbeat() {
+	interval := l.lease / 3
+	wait := interval
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-l.retry:
+		case <-time.After(wait):
+		}
+		// Bound each attempt, so a hung store doesn't block release.
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := l.renew(ctx)
+		cancel()
+		if err == nil {
+			wait = interval
+		} else if l.lost() {
+			return
+		} else {
+			wait = interval / 5
+		}
+	}
+}
+
+// record sets the revision being deployed, and renews the lease to store it.
+// If renewing fails but the lock isn't lost, the heartbeat retries it, so
+// only losing the lock is an error.
+func (l *deployLease) record(ctx context.Context, taskDef TaskDefinitionID) error {
+	l.mu.Lock()
+	l.taskDef = taskDef
+	l.mu.Unlock()
+	err := l.renew(ctx)
+	if err != nil && !l.lost() {
+		select {
+		case l.retry <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	return err
+}
+
+// renew extends the lease, and records the revision being deployed if set.
+// If the lock has been taken by another deploy, or has expired, it is lost and
+// the deploy is cancelled. Other errors can be retried. Once released, renew
+// does nothing.
+func (l *deployLease) renew(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	} else if l.released {
+		return nil
+	}
+	lock := l.lock
+	lock.Expires = l.now().Add(l.lease)
+	if !l.taskDef.IsZero() {
+		lock.TaskDefinition = l.taskDef
+	}
+	err := l.store.Acquire(ctx, lock, false)
+	if err == nil {
+		l.lock = lock
+		return nil
+	}
+	var held *LockHeldError
+	if errors.As(err, &held) || !l.now().Before(l.lock.Expires) {
+		l.err = err
+		if l.cancel != nil {
+			l.cancel()
+		}
+	}
+	return err
+}
+
+// lost returns true if the lock has been lost.
+func (l *deployLease) lost() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err != nil
+}
+
+// release stops renewing the lease and releases the lock. It returns an error
+// if the lock was lost, for example because it was broken by another deploy.
+func (l *deployLease) release(ctx context.Context) error {
+	close(l.done)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.released = true
+	if l.err == nil {
+		// Check the lock wasn't broken since it was last renewed.
+		l.err = l.store.Acquire(ctx, l.lock, false)
+	}
+	if l.err != nil {
+		return propagate(l.err, "lost deploy lock")
+	}
+	return l.store.Release(ctx, l.lock)
+}
+
+// ConditionalStore is a key-value store with conditional writes, like
+// DynamoDB's condition expressions.
+type ConditionalStore interface {
+	// Get returns the value of key, or nil if it isn't set.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Put sets key to value if its current value is prev, nil meaning unset,
+	// otherwise it returns ErrConditionFailed.
+	Put(ctx context.Context, key string, prev, value []byte) error
+
+	// Delete removes key if its current value is prev, otherwise it returns
+	// ErrConditionFailed.
+	Delete(ctx context.Context, key string, prev []byte) error
+}
+
+// NewConditionalLockStore returns a LockStore that keeps locks in a
+// ConditionalStore, such as a DynamoDBStore.
+func NewConditionalLockStore(store ConditionalStore) LockStore {
+	return &conditionalLockStore{store: store, now: time.Now}
+}
+
+type conditionalLockStore struct {
+	store ConditionalStore
+	now   func() time.Time
+}
+
+func (s *conditionalLockStore) get(ctx context.Context, key string) ([]byte, *DeployLock, error) {
+	b, err := s.store.Get(ctx, key)
+	if err != nil || b == nil {
+		return nil, nil, err
+	}
+	current := &DeployLock{}
+	if err := json.Unmarshal(b, current); err != nil {
+		return nil, nil, propagate(err, "invalid deploy lock")
+	}
+	return b, current, nil
+}
+
+func (s *conditionalLockStore) Acquire(ctx context.Context, lock DeployLock, force bool) error {
+	value, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	for {
+		prev, current, err := s.get(ctx, lock.Key)
+		if err != nil {
+			return err
+		}
+		if err := checkLock(current, lock, force, s.now()); err != nil {
+			return err
+		}
+		// If the lock changed since it was read, check it again.
+		if err := s.store.Put(ctx, lock.Key, prev, value); err != ErrConditionFailed {
+			return err
+		}
+	}
+}
+
+func (s *conditionalLockStore) Release(ctx context.Context, lock DeployLock) error {
+	prev, current, err := s.get(ctx, lock.Key)
+	if err != nil || current == nil || current.ID != lock.ID {
+		return err
+	}
+	if err := s.store.Delete(ctx, lock.Key, prev); err != nil && err != ErrConditionFailed {
+		return err
+	}
+	return nil
+}
+
+// MemoryStore is an in-memory ConditionalStore, for tests and for deploys
+// within a single process.
+type MemoryStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: map[string][]byte{}}
+}
+
+// Get implements ConditionalStore.
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key], nil
+}
+
+// Put implements ConditionalStore.
+func (s *MemoryStore) Put(ctx context.Context, key string, prev, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.matches(key, prev) {
+		return ErrConditionFailed
+	}
+	s.values[key] = value
+	return nil
+}
+
+// Delete implements ConditionalStore.
+func (s *MemoryStore) Delete(ctx context.Context, key string, prev []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.matches(key, prev) {
+		return ErrConditionFailed
+	}
+	delete(s.values, key)
+	return nil
+}
+
+func (s *MemoryStore) matches(key string, prev []byte) bool {
+	current, ok := s.values[key]
+	if prev == nil {
+		return !ok
+	}
+	return ok && string(current) == string(prev)
+}
@@ -0,0 +1,197 @@
+package esu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeployLocked(t *testing.T) {
+	f := newFakeECS("website:v1")
+	mem := NewMemoryStore()
+	d, events := testDeployer(f)
+	d.Locks = NewConditionalLockStore(mem)
+	d.LockHolder = "alice@laptop"
+
+	other := DeployLock{Key: "sites/website", ID: "other", Holder: "bob@desktop", Started: time.Now(), Expires: time.Now().Add(time.Hour)}
+	if err := d.Locks.Acquire(context.Background(), other, false); err != nil {
+		t.Fatal(err)
+	}
+	_, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2"})
+	if held, ok := err.(*LockHeldError); !ok || held.Lock.Holder != "bob@desktop" {
+		t.Errorf("expected lock held by bob, was %v", err)
+	}
+	if len(f.registered) != 0 {
+		t.Errorf("nothing should be registered while locked: %v", f.registered)
+	}
+
+	// While deploying, the lock records the revision being deployed.
+	var locked DeployLock
+	d.OnProgress = func(e DeployEvent) {
+		*events = append(*events, e)
+		if e.Stage == DeployStageUpdate {
+			b, _ := mem.Get(context.Background(), "sites/website")
+			json.Unmarshal(b, &locked)
+		}
+	}
+	if _, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2", BreakLock: true}); err != nil {
+		t.Fatal(err)
+	}
+	if locked.Holder != "alice@laptop" || locked.TaskDefinition.String() != "website:2" {
+		t.Errorf("unexpected lock during deploy: %#v", locked)
+	}
+	broke := false
+	for _, e := range *events {
+		broke = broke || strings.HasPrefix(e.Message, "Breaking deploy lock: sites/website locked by bob@desktop")
+	}
+	if !broke {
+		t.Errorf("expected breaking the lock to be reported")
+	}
+	if b, _ := mem.Get(context.Background(), "sites/website"); b != nil {
+		t.Errorf("expected lock to be released: %s", b)
+	}
+}
+
+func TestDeployLockLost(t *testing.T) {
+	f := newFakeECS("website:v1")
+	d, _ := testDeployer(f)
+	d.Locks = NewConditionalLockStore(NewMemoryStore())
+
+	// Someone else breaks the lock mid-deploy.
+	d.OnProgress = func(e DeployEvent) {
+		if e.Stage == DeployStageUpdate {
+			other := DeployLock{Key: "sites/website", ID: "other", Holder: "bob@desktop", Expires: time.Now().Add(time.Hour)}
+			d.Locks.Acquire(context.Background(), other, true)
+		}
+	}
+	_, err := d.Deploy(context.Background(), DeployRequest{Service: "website", Tag: "v2"})
+	if err == nil || !strings.Contains(err.Error(), "lost deploy lock") {
+		t.Errorf("expected lost lock, was %v", err)
+	}
+}
+
+func TestDeployLease(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	mem := NewMemoryStore()
+	d, _ := testDeployer(newFakeECS("website:v1"))
+	d.Locks = &conditionalLockStore{store: mem, now: clock.Now}
+	d.LockLease = time.Minute
+	d.now = clock.Now
+
+	lease, err := d.lock(context.Background(), DeployRequest{Service: "website"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.t = clock.t.Add(50 * time.Second)
+	if err := lease.record(context.Background(), TaskDefinitionID{"website", 3}); err != nil {
+		t.Fatal(err)
+	}
+	if lease.lock.Expires != time.Unix(1110, 0) || lease.lock.TaskDefinition.String() != "website:3" {
+		t.Errorf("unexpected lease %s", lease.lock)
+	}
+	if err := lease.release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A heartbeat that was waiting for the lease when it was released doesn't
+	// recreate the lock.
+	if err := lease.renew(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := mem.Get(context.Background(), "sites/website"); b != nil {
+		t.Errorf("expected lock to stay released: %s", b)
+	}
+}
+
+// flakyLockStore fails the given number of Acquire calls.
+type flakyLockStore struct {
+	LockStore
+	mu       sync.Mutex
+	failures int
+}
+
+func (s *flakyLockStore) Acquire(ctx context.Context, lock DeployLock, force bool) error {
+	s.mu.Lock()
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	s.mu.Unlock()
+	if fail {
+		return errors.New("ThrottlingException: rate exceeded")
+	}
+	return s.LockStore.Acquire(ctx, lock, force)
+}
+
+func TestDeployLeaseHeartbeat(t *testing.T) {
+	store := &flakyLockStore{LockStore: NewConditionalLockStore(NewMemoryStore())}
+	d, _ := testDeployer(newFakeECS("website:v1"))
+	d.Locks = store
+	d.LockLease = 300 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lease, err := d.lock(ctx, DeployRequest{Service: "website"}, cancel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Transient errors are retried without losing the lock.
+	store.mu.Lock()
+	store.failures = 2
+	store.mu.Unlock()
+	time.Sleep(250 * time.Millisecond)
+	if lease.lost() || ctx.Err() != nil {
+		t.Fatalf("transient errors shouldn't lose the lock: %v", lease.err)
+	}
+
+	// Losing the lock cancels the deploy.
+	other := DeployLock{Key: "sites/website", ID: "other", Holder: "bob@desktop", Expires: time.Now().Add(time.Hour)}
+	store.Acquire(context.Background(), other, true)
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected deploy to be cancelled when the lock is lost")
+	}
+	if err := lease.release(context.Background()); err == nil || !strings.Contains(err.Error(), "lost deploy lock") {
+		t.Errorf("expected lost lock, was %v", err)
+	}
+}
+
+func TestDeployLeaseRecordRetried(t *testing.T) {
+	mem := NewMemoryStore()
+	store := &flakyLockStore{LockStore: NewConditionalLockStore(mem)}
+	d, _ := testDeployer(newFakeECS("website:v1"))
+	d.Locks = store
+	d.LockLease = time.Hour
+
+	lease, err := d.lock(context.Background(), DeployRequest{Service: "website"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.release(context.Background())
+
+	// A transient error recording the revision doesn't fail the deploy, and
+	// the heartbeat retries it straight away.
+	store.mu.Lock()
+	store.failures = 1
+	store.mu.Unlock()
+	if err := lease.record(context.Background(), TaskDefinitionID{"website", 3}); err != nil {
+		t.Fatalf("transient errors shouldn't fail the deploy: %s", err)
+	}
+	var locked DeployLock
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		b, _ := mem.Get(context.Background(), "sites/website")
+		json.Unmarshal(b, &locked)
+		if !locked.TaskDefinition.IsZero() {
+			break
+		}
+	}
+	if locked.TaskDefinition.String() != "website:3" {
+		t.Errorf("expected revision to be recorded by the heartbeat, was %#v", locked)
+	}
+}
@@ -0,0 +1,213 @@
+// Package dnsserver answers DNS queries for ECS services, so that clients which
+// can't use the esu library directly can still discover running tasks.
+//
+// A queries for "<service>.<cluster>.esu." return the private IPs of the
+// service's running tasks. SRV queries for the same name return one record per
+// task, with the host port and a target of "<task-id>.<service>.<cluster>.esu.".
+// The targets resolve via A queries and are also included in the additional
+// section. UDP responses are truncated to 512 bytes, or the client's EDNS0
+// buffer size, and queries outside the domain are refused.
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dpup/esu"
+	"github.com/miekg/dns"
+)
+
+// DefaultDomain is the zone the server is authoritative for.
+const DefaultDomain = "esu."
+
+// DefaultTTL is the TTL of answers. It is short as tasks come and go.
+const DefaultTTL = 5 * time.Second
+
+// DefaultNegativeTTL is how long resolvers should cache NXDOMAIN responses.
+const DefaultNegativeTTL = 30 * time.Second
+
+// Server is a dns.Handler that answers queries using TaskMonitors.
+type Server struct {
+	Domain      string
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	mu       sync.RWMutex
+	monitors map[string]*esu.TaskMonitor
+}
+
+// New returns a server with the default domain and TTLs.
+func New() *Server {
+	return &Server{
+		Domain:      DefaultDomain,
+		TTL:         DefaultTTL,
+		NegativeTTL: DefaultNegativeTTL,
+		monitors:    map[string]*esu.TaskMonitor{},
+	}
+}
+
+// AddService answers queries for "<service>.<cluster>.<domain>" using the
+// monitor's running tasks. The caller is responsible for starting the monitor.
+func (s *Server) AddService(cluster, service string, tm *esu.TaskMonitor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.monitors[s.serviceName(cluster, service)] = tm
+}
+
+// ListenAndServe listens for UDP and TCP queries on addr, returning when either
+// listener fails.
+func (s *Server) ListenAndServe(addr string) error {
+	errs := make(chan error, 2)
+	for _, proto := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: addr, Net: proto, Handler: s}
+		go func(srv *dns.Server) {
+			errs <- srv.ListenAndServe()
+		}(srv)
+	}
+	return <-errs
+}
+
+// ServeDNS implements dns.Handler.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	switch {
+	case len(req.Question) != 1:
+		m.Rcode = dns.RcodeFormatError
+	case !s.inZone(strings.ToLower(req.Question[0].Name)):
+		m.Rcode = dns.RcodeRefused
+	default:
+		m.Authoritative = true
+		s.answer(m, req.Question[0])
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+			m.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		if size > dns.DefaultMsgSize {
+			size = dns.DefaultMsgSize
+		}
+		m.Truncate(size)
+	}
+	w.WriteMsg(m)
+}
+
+func (s *Server) answer(m *dns.Msg, q dns.Question) {
+	name := strings.ToLower(q.Name)
+	tasks, host, ok := s.lookup(name)
+	if !ok {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{s.soa()}
+		return
+	}
+	// Tasks on the same instance can share an IP.
+	seen := map[string]bool{}
+	for _, t := range tasks {
+		switch {
+		case q.Qtype == dns.TypeA:
+			if rr := s.a(name, t); rr != nil && !seen[t.PrivateIPAddress] {
+				seen[t.PrivateIPAddress] = true
+				m.Answer = append(m.Answer, rr)
+			}
+		case q.Qtype == dns.TypeSRV && host == "":
+			target := hostLabel(t) + "." + name
+			m.Answer = append(m.Answer, &dns.SRV{
+				Hdr:      s.header(name, dns.TypeSRV),
+				Priority: 1,
+				Weight:   1,
+				Port:     uint16(t.Port),
+				Target:   target,
+			})
+			if rr := s.a(target, t); rr != nil {
+				m.Extra = append(m.Extra, rr)
+			}
+		}
+	}
+	if len(m.Answer) == 0 {
+		// Known name with no matching records, NODATA.
+		m.Ns = []dns.RR{s.soa()}
+	}
+}
+
+// lookup finds the running tasks for a query name. If the name is a task's
+// SRV target, the task's host label is also returned.
+func (s *Server) lookup(name string) ([]esu.TaskInfo, string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if tm, ok := s.monitors[name]; ok {
+		return tm.RunningTasks(), "", true
+	}
+	i := strings.Index(name, ".")
+	if i == -1 {
+		return nil, "", false
+	}
+	tm, ok := s.monitors[name[i+1:]]
+	if !ok {
+		return nil, "", false
+	}
+	host := name[:i]
+	for _, t := range tm.RunningTasks() {
+		if hostLabel(t) == host {
+			return []esu.TaskInfo{t}, host, true
+		}
+	}
+	return nil, "", false
+}
+
+func (s *Server) a(name string, t esu.TaskInfo) dns.RR {
+	ip := net.ParseIP(t.PrivateIPAddress).To4()
+	if ip == nil {
+		return nil
+	}
+	return &dns.A{Hdr: s.header(name, dns.TypeA), A: ip}
+}
+
+func (s *Server) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(s.TTL / time.Second),
+	}
+}
+
+func (s *Server) soa() dns.RR {
+	ttl := uint32(s.NegativeTTL / time.Second)
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: s.domain(), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "ns." + s.domain(),
+		Mbox:    "hostmaster." + s.domain(),
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+func (s *Server) inZone(name string) bool {
+	domain := s.domain()
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+func (s *Server) domain() string {
+	return dns.Fqdn(strings.ToLower(s.Domain))
+}
+
+func (s *Server) serviceName(cluster, service string) string {
+	return strings.ToLower(fmt.Sprintf("%s.%s.%s", service, cluster, s.domain()))
+}
+
+// hostLabel returns the DNS label used to address a single task. Tasks can
+// share an IP, so the task ID is used, or the IP and port if it isn't known.
+func hostLabel(t esu.TaskInfo) string {
+	if id := t.TaskID(); id != "" {
+		return strings.ToLower(id)
+	}
+	return fmt.Sprintf("%s-%d", strings.Replace(t.PrivateIPAddress, ".", "-", -1), t.Port)
+}
@@ -0,0 +1,187 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dpup/esu"
+	"github.com/miekg/dns"
+)
+
+type fakeLister struct {
+	tasks []esu.TaskInfo
+}
+
+func (f *fakeLister) Tasks(service string) ([]esu.TaskInfo, error) {
+	return f.tasks, nil
+}
+
+func task(ip string, port int) esu.TaskInfo {
+	return esu.TaskInfo{
+		TaskDefinition:   esu.TaskDefinitionID{Family: "website", Revision: 1},
+		DesiredStatus:    esu.ECSTaskStatusRunning,
+		LastStatus:       esu.ECSTaskStatusRunning,
+		EC2InstanceID:    "i-" + ip,
+		PrivateIPAddress: ip,
+		Port:             port,
+	}
+}
+
+// startServer runs the server on loopback UDP and TCP ports, returning the
+// address of each.
+func startServer(t *testing.T, s *Server) (string, string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: s}
+	tcp := &dns.Server{Listener: l, Handler: s}
+	started := make(chan bool, 2)
+	udp.NotifyStartedFunc = func() { started <- true }
+	tcp.NotifyStartedFunc = func() { started <- true }
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	<-started
+	<-started
+	return pc.LocalAddr().String(), l.Addr().String(), func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	}
+}
+
+func query(t *testing.T, proto, addr, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	c := &dns.Client{Net: proto, Timeout: 2 * time.Second}
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("%s query for %s failed: %s", proto, name, err)
+	}
+	return r
+}
+
+func TestServer(t *testing.T) {
+	tm := esu.NewTaskMonitorWithLister(&fakeLister{tasks: []esu.TaskInfo{
+		task("10.0.0.1", 32768),
+		task("10.0.0.2", 32769),
+	}}, "website")
+	tm.Update()
+
+	s := New()
+	s.TTL = 10 * time.Second
+	s.AddService("sites", "website", tm)
+	udpAddr, tcpAddr, stop := startServer(t, s)
+	defer stop()
+
+	for proto, addr := range map[string]string{"udp": udpAddr, "tcp": tcpAddr} {
+		r := query(t, proto, addr, "website.sites.esu.", dns.TypeA)
+		if r.Rcode != dns.RcodeSuccess || !r.Authoritative {
+			t.Errorf("%s: unexpected response %s", proto, r)
+		}
+		var ips []string
+		for _, rr := range r.Answer {
+			a := rr.(*dns.A)
+			ips = append(ips, a.A.String())
+			if a.Hdr.Ttl != 10 {
+				t.Errorf("%s: TTL was %d, wanted 10", proto, a.Hdr.Ttl)
+			}
+		}
+		sort.Strings(ips)
+		if len(ips) != 2 || ips[0] != "10.0.0.1" || ips[1] != "10.0.0.2" {
+			t.Errorf("%s: unexpected A records %v", proto, ips)
+		}
+
+		r = query(t, proto, addr, "website.sites.esu.", dns.TypeSRV)
+		if len(r.Answer) != 2 || len(r.Extra) != 2 {
+			t.Fatalf("%s: expected 2 SRV records and 2 additional records, got %s", proto, r)
+		}
+		for _, rr := range r.Answer {
+			srv := rr.(*dns.SRV)
+			tr := query(t, proto, addr, srv.Target, dns.TypeA)
+			if len(tr.Answer) != 1 {
+				t.Fatalf("%s: expected SRV target %s to resolve, got %s", proto, srv.Target, tr)
+			}
+			ip := tr.Answer[0].(*dns.A).A.String()
+			if (ip == "10.0.0.1" && srv.Port != 32768) || (ip == "10.0.0.2" && srv.Port != 32769) {
+				t.Errorf("%s: SRV port %d doesn't match task %s", proto, srv.Port, ip)
+			}
+		}
+
+		r = query(t, proto, addr, "unknown.sites.esu.", dns.TypeA)
+		if r.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: expected NXDOMAIN for unknown service, got %s", proto, dns.RcodeToString[r.Rcode])
+		}
+		if len(r.Ns) != 1 || r.Ns[0].Header().Ttl != uint32(DefaultNegativeTTL/time.Second) {
+			t.Errorf("%s: expected SOA with negative TTL, got %v", proto, r.Ns)
+		}
+
+		r = query(t, proto, addr, "website.sites.esu.", dns.TypeAAAA)
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+			t.Errorf("%s: expected empty NOERROR for AAAA, got %s", proto, r)
+		}
+	}
+}
+
+func TestServerSharedIPsAndTruncation(t *testing.T) {
+	// Bridge mode tasks on the same instance share an IP.
+	var tasks []esu.TaskInfo
+	for i := 0; i < 40; i++ {
+		tk := task(fmt.Sprintf("10.0.0.%d", i%2+1), 32768+i)
+		tk.TaskARN = fmt.Sprintf("arn:aws:ecs:us-east-1:12345678:task/sites/%032x", i)
+		tasks = append(tasks, tk)
+	}
+	tm := esu.NewTaskMonitorWithLister(&fakeLister{tasks: tasks}, "website")
+	tm.Update()
+	s := New()
+	s.AddService("sites", "website", tm)
+	udpAddr, tcpAddr, stop := startServer(t, s)
+	defer stop()
+
+	r := query(t, "udp", udpAddr, "website.sites.esu.", dns.TypeA)
+	if len(r.Answer) != 2 {
+		t.Errorf("expected one A record per IP, got %s", r)
+	}
+
+	r = query(t, "tcp", tcpAddr, "website.sites.esu.", dns.TypeSRV)
+	targets := map[string]bool{}
+	for _, rr := range r.Answer {
+		targets[rr.(*dns.SRV).Target] = true
+	}
+	if len(r.Answer) != 40 || len(targets) != 40 {
+		t.Errorf("expected a distinct target per task, got %d records and %d targets", len(r.Answer), len(targets))
+	}
+	tr := query(t, "tcp", tcpAddr, r.Answer[5].(*dns.SRV).Target, dns.TypeA)
+	if len(tr.Answer) != 1 {
+		t.Errorf("expected SRV target to resolve, got %s", tr)
+	}
+
+	// UDP responses are truncated to fit, signalling the client to use TCP.
+	r = query(t, "udp", udpAddr, "website.sites.esu.", dns.TypeSRV)
+	r.Compress = true
+	if !r.Truncated || r.Len() > dns.MinMsgSize {
+		t.Errorf("expected truncated response within 512 bytes, got %d bytes truncated=%v", r.Len(), r.Truncated)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("website.sites.esu.", dns.TypeSRV)
+	m.SetEdns0(4096, false)
+	r, _, err := (&dns.Client{Net: "udp", UDPSize: 4096}).Exchange(m, udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated || len(r.Answer) != 40 {
+		t.Errorf("expected EDNS0 buffer to fit all records, got %d truncated=%v", len(r.Answer), r.Truncated)
+	}
+
+	// Names outside the zone are refused.
+	r = query(t, "udp", udpAddr, "example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeRefused || r.Authoritative {
+		t.Errorf("expected REFUSED for other zones, got %s", dns.RcodeToString[r.Rcode])
+	}
+}
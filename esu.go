@@ -12,50 +12,94 @@ import (
 	"strings"
 )
 
-// ARN contains fields within an ARN used by ECS services.
+// ARN contains the fields of an Amazon Resource Name, as used by ECS.
 //
 // arn:aws:ecs:region:account-id:task-definition/task-definition-family-name:task-definition-revision-number
-// arn:aws:ecs:region:account-id:container/container-id
-// arn:aws:ecr:region:account-id:repository/repo:tag
+// arn:aws:ecs:region:account-id:container-instance/container-instance-id
+// arn:aws:ecs:region:account-id:task/cluster-name/task-id
+// arn:aws:ecs:region:account-id:service/cluster-name/service-name
 type ARN struct {
-	Prefix   string // Region + Account + Resource Type
-	Resource string
-	Revision string
+	Partition    string
+	Service      string
+	Region       string
+	AccountID    string
+	ResourceType string
+	ResourcePath []string // Segments following the resource type.
+	Revision     string
 }
 
-// ShortName returns "Resource:Revision"
-func (td ARN) ShortName() string {
-	if td.Revision != "" {
-		return fmt.Sprintf("%s:%s", td.Resource, td.Revision)
+// Name returns the last segment of the resource path, for example the task
+// definition family, task ID or service name.
+func (a ARN) Name() string {
+	if len(a.ResourcePath) == 0 {
+		return ""
 	}
-	return td.Resource
+	return a.ResourcePath[len(a.ResourcePath)-1]
 }
 
-// String returns the full ARN (if fields are set).
-func (td ARN) String() string {
-	if td.Prefix == "" {
-		return td.ShortName()
+// Cluster returns the cluster name embedded in long format task, service and
+// container instance ARNs, or an empty string for the older short format.
+func (a ARN) Cluster() string {
+	switch a.ResourceType {
+	case "task", "service", "container-instance":
+		if len(a.ResourcePath) == 2 {
+			return a.ResourcePath[0]
+		}
 	}
-	return fmt.Sprintf("%s/%s", td.Prefix, td.ShortName())
+	return ""
 }
 
-// ParseARN parses an ARN.
-func ParseARN(arn string) ARN {
-	var prefix string
-	var resource string
-	var revision string
-
-	i := strings.Index(arn, "/")
-	if i != -1 {
-		prefix = arn[:i]
-		arn = arn[i+1:]
-	}
-	j := strings.Index(arn, ":")
-	if j != -1 {
-		resource = arn[:j]
-		revision = arn[j+1:]
-	} else {
-		resource = arn
-	}
-	return ARN{prefix, resource, revision}
+// ShortName returns "Name:Revision", or just the name if there's no revision.
+func (a ARN) ShortName() string {
+	if a.Revision != "" {
+		return fmt.Sprintf("%s:%s", a.Name(), a.Revision)
+	}
+	return a.Name()
+}
+
+// String returns the full ARN.
+func (a ARN) String() string {
+	resource := strings.Join(a.ResourcePath, "/")
+	if a.ResourceType != "" {
+		resource = a.ResourceType + "/" + resource
+	}
+	if a.Revision != "" {
+		resource += ":" + a.Revision
+	}
+	return fmt.Sprintf("arn:%s:%s:%s:%s:%s", a.Partition, a.Service, a.Region, a.AccountID, resource)
+}
+
+// ParseARN parses an ARN of the form
+// "arn:partition:service:region:account-id:resource-type/resource[:revision]".
+func ParseARN(arn string) (ARN, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return ARN{}, fmt.Errorf("invalid ARN %q", arn)
+	}
+	a := ARN{
+		Partition: parts[1],
+		Service:   parts[2],
+		Region:    parts[3],
+		AccountID: parts[4],
+	}
+	if a.Partition == "" || a.Service == "" || parts[5] == "" {
+		return ARN{}, fmt.Errorf("invalid ARN %q", arn)
+	}
+
+	resource := parts[5]
+	if i := strings.Index(resource, "/"); i != -1 {
+		a.ResourceType = resource[:i]
+		resource = resource[i+1:]
+	}
+	if i := strings.LastIndex(resource, ":"); i != -1 {
+		a.Revision = resource[i+1:]
+		resource = resource[:i]
+	}
+	a.ResourcePath = strings.Split(resource, "/")
+	for _, s := range a.ResourcePath {
+		if s == "" {
+			return ARN{}, fmt.Errorf("invalid ARN %q, empty resource segment", arn)
+		}
+	}
+	return a, nil
 }
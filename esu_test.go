@@ -1,23 +1,74 @@
 package esu
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestParseARN(t *testing.T) {
 	cases := map[string]ARN{
-		"family":     {"", "family", ""},
-		"family:123": {"", "family", "123"},
-		"family:456": {"", "family", "456"},
-		"arn:aws:ecs:us-east-1:12345678:task-definition/family:456":     {"arn:aws:ecs:us-east-1:12345678:task-definition", "family", "456"},
-		"arn:aws:ecs:us-east-1:12345678:container-instance/containerid": {"arn:aws:ecs:us-east-1:12345678:container-instance", "containerid", ""},
+		"arn:aws:ecs:us-east-1:12345678:task-definition/family:456": {
+			"aws", "ecs", "us-east-1", "12345678", "task-definition", []string{"family"}, "456"},
+		"arn:aws:ecs:us-east-1:12345678:container-instance/containerid": {
+			"aws", "ecs", "us-east-1", "12345678", "container-instance", []string{"containerid"}, ""},
+		"arn:aws:ecs:us-east-1:12345678:task/cluster-name/taskid": {
+			"aws", "ecs", "us-east-1", "12345678", "task", []string{"cluster-name", "taskid"}, ""},
+		"arn:aws:ecs:us-east-1:12345678:service/cluster-name/website": {
+			"aws", "ecs", "us-east-1", "12345678", "service", []string{"cluster-name", "website"}, ""},
+		"arn:aws-cn:ecs:cn-north-1:12345678:cluster/sites": {
+			"aws-cn", "ecs", "cn-north-1", "12345678", "cluster", []string{"sites"}, ""},
+		"arn:aws:iam::12345678:role/deploy": {
+			"aws", "iam", "", "12345678", "role", []string{"deploy"}, ""},
 	}
 
 	for s, e := range cases {
 		if e.String() != s {
-			t.Errorf("String() error, wanted %s, was %s", e, s)
+			t.Errorf("String() error, wanted %s, was %s", s, e)
 		}
-		a := ParseARN(s)
-		if a != e {
-			t.Errorf("Parse error, wanted %s was %s", e, a)
+		a, err := ParseARN(s)
+		if err != nil {
+			t.Errorf("Parse error for %s: %s", s, err)
+		} else if !reflect.DeepEqual(a, e) {
+			t.Errorf("Parse error, wanted %#v was %#v", e, a)
+		}
+	}
+}
+
+func TestParseARNInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"family",
+		"family:123",
+		"repo:tag",
+		"arn:aws:ecs:us-east-1:12345678",
+		"arn::ecs:us-east-1:12345678:task/id",
+		"arn:aws:ecs:us-east-1:12345678:",
+		"arn:aws:ecs:us-east-1:12345678:task//id",
+		"nra:aws:ecs:us-east-1:12345678:task/id",
+	}
+	for _, s := range invalid {
+		if a, err := ParseARN(s); err == nil {
+			t.Errorf("expected error parsing %q, got %#v", s, a)
+		}
+	}
+}
+
+func TestARNNames(t *testing.T) {
+	cases := []struct {
+		arn, name, shortName, cluster string
+	}{
+		{"arn:aws:ecs:us-east-1:12345678:task-definition/family:456", "family", "family:456", ""},
+		{"arn:aws:ecs:us-east-1:12345678:task/taskid", "taskid", "taskid", ""},
+		{"arn:aws:ecs:us-east-1:12345678:task/sites/taskid", "taskid", "taskid", "sites"},
+		{"arn:aws:ecs:us-east-1:12345678:service/sites/website", "website", "website", "sites"},
+	}
+	for _, c := range cases {
+		a, err := ParseARN(c.arn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Name() != c.name || a.ShortName() != c.shortName || a.Cluster() != c.cluster {
+			t.Errorf("%s: got name=%s shortName=%s cluster=%s", c.arn, a.Name(), a.ShortName(), a.Cluster())
 		}
 	}
 }
@@ -0,0 +1,166 @@
+// Package grpcresolver provides a gRPC name resolver that discovers the running
+// tasks of an ECS service using a TaskMonitor.
+//
+// Targets take the form "esu:///cluster/service":
+//
+//	grpcresolver.Register(sess)
+//	conn, err := grpc.NewClient("esu:///sites/website", opts...)
+package grpcresolver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dpup/esu"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme is the URL scheme handled by the resolver.
+const Scheme = "esu"
+
+type attrKey string
+
+const (
+	availabilityZoneKey = attrKey("availability-zone")
+	taskDefinitionKey   = attrKey("task-definition")
+)
+
+// Builder creates resolvers for "esu:///cluster/service" targets. Each target
+// gets its own TaskMonitor.
+type Builder struct {
+	newLister func(cluster string) esu.TaskLister
+}
+
+// NewBuilder returns a builder that queries ECS using the given session.
+func NewBuilder(sess *session.Session) *Builder {
+	return NewBuilderWithLister(func(cluster string) esu.TaskLister {
+		return esu.NewTaskFinder(sess, cluster)
+	})
+}
+
+// NewBuilderWithLister returns a builder which uses the provided function to
+// create a TaskLister for each cluster.
+func NewBuilderWithLister(newLister func(cluster string) esu.TaskLister) *Builder {
+	return &Builder{newLister: newLister}
+}
+
+// Register registers a builder for the "esu" scheme with gRPC's global
+// resolver registry. It should be called during initialization.
+func Register(sess *session.Session) {
+	resolver.Register(NewBuilder(sess))
+}
+
+// Scheme implements resolver.Builder.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+// Build implements resolver.Builder.
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	cluster, service, err := parseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	r := &esuResolver{
+		cc:         cc,
+		tm:         esu.NewTaskMonitorWithLister(b.newLister(cluster), service),
+		resolveNow: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	r.tm.OnTaskChange = r.push
+	r.tm.OnError = func(err error) {
+		// Once addresses have been resolved, keep using them through
+		// transient errors.
+		if r.tm.LastSuccessfulUpdate().IsZero() {
+			cc.ReportError(err)
+		}
+	}
+	r.tm.Update()
+	go r.watch()
+
+	// OnTaskChange doesn't fire if the service starts out with no tasks, so make
+	// sure the ClientConn hears about the initial state.
+	if len(r.tm.RunningTasks()) == 0 {
+		r.push(nil)
+	}
+	return r, nil
+}
+
+// parseTarget splits "/cluster/service" into its parts.
+func parseTarget(target resolver.Target) (string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(target.URL.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid esu target %q, expected esu:///cluster/service", target.URL.String())
+	}
+	return parts[0], parts[1], nil
+}
+
+// AvailabilityZone returns the availability zone of the task backing an
+// address, for use by balancing policies.
+func AvailabilityZone(addr resolver.Address) string {
+	s, _ := addr.BalancerAttributes.Value(availabilityZoneKey).(string)
+	return s
+}
+
+// TaskDefinition returns the task definition of the task backing an address,
+// for use by balancing policies.
+func TaskDefinition(addr resolver.Address) esu.TaskDefinitionID {
+	id, _ := addr.BalancerAttributes.Value(taskDefinitionKey).(esu.TaskDefinitionID)
+	return id
+}
+
+type esuResolver struct {
+	cc         resolver.ClientConn
+	tm         *esu.TaskMonitor
+	resolveNow chan struct{}
+	done       chan struct{}
+}
+
+// watch updates the monitor at its poll frequency, or sooner when asked to
+// resolve now. Updates run one at a time, so addresses are pushed in order.
+func (r *esuResolver) watch() {
+	for {
+		freq := r.tm.PollFreq
+		if r.tm.IsVolatile() {
+			freq = r.tm.VolatilePollFreq
+		}
+		select {
+		case <-r.done:
+			return
+		case <-r.resolveNow:
+		case <-time.After(freq):
+		}
+		r.tm.Update()
+	}
+}
+
+func (r *esuResolver) push(tasks []esu.TaskInfo) {
+	addrs := make([]resolver.Address, len(tasks))
+	for i, t := range tasks {
+		addrs[i] = resolver.Address{
+			Addr: t.PrivateAddress(),
+			BalancerAttributes: attributes.New(availabilityZoneKey, t.AvailabilityZone).
+				WithValue(taskDefinitionKey, t.TaskDefinition),
+		}
+	}
+	if err := r.cc.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+		r.cc.ReportError(err)
+	}
+}
+
+// ResolveNow implements resolver.Resolver. Calls made while an update is
+// pending are coalesced into it.
+func (r *esuResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+// Close implements resolver.Resolver.
+func (r *esuResolver) Close() {
+	close(r.done)
+}
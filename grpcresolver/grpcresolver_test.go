@@ -0,0 +1,238 @@
+package grpcresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dpup/esu"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeLister struct {
+	tasks []esu.TaskInfo
+}
+
+func (f *fakeLister) Tasks(service string) ([]esu.TaskInfo, error) {
+	return f.tasks, nil
+}
+
+func TestResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	var clusters []string
+	b := NewBuilderWithLister(func(cluster string) esu.TaskLister {
+		clusters = append(clusters, cluster)
+		return &fakeLister{tasks: []esu.TaskInfo{{
+			TaskDefinition:   esu.TaskDefinitionID{Family: "website", Revision: 3},
+			DesiredStatus:    esu.ECSTaskStatusRunning,
+			LastStatus:       esu.ECSTaskStatusRunning,
+			EC2InstanceID:    "i-1234",
+			PrivateIPAddress: "127.0.0.1",
+			Port:             port,
+			AvailabilityZone: "us-east-1a",
+		}}}
+	})
+
+	conn, err := grpc.NewClient("esu:///sites/website",
+		grpc.WithResolvers(b),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("unexpected health status %s", resp.Status)
+	}
+	if len(clusters) != 1 || clusters[0] != "sites" {
+		t.Errorf("expected lister for cluster sites, got %v", clusters)
+	}
+}
+
+func TestPush(t *testing.T) {
+	cc := &recordingConn{}
+	r := &esuResolver{cc: cc}
+	r.push([]esu.TaskInfo{{
+		TaskDefinition:   esu.TaskDefinitionID{Family: "website", Revision: 3},
+		PrivateIPAddress: "10.0.0.1",
+		Port:             8080,
+		AvailabilityZone: "us-east-1b",
+	}})
+	if len(cc.addrs) != 1 {
+		t.Fatalf("expected 1 address, got %d", len(cc.addrs))
+	}
+	a := cc.addrs[0]
+	if a.Addr != "10.0.0.1:"+strconv.Itoa(8080) {
+		t.Errorf("unexpected address %s", a.Addr)
+	}
+	if AvailabilityZone(a) != "us-east-1b" {
+		t.Errorf("unexpected availability zone %q", AvailabilityZone(a))
+	}
+	if TaskDefinition(a).String() != "website:3" {
+		t.Errorf("unexpected task definition %q", TaskDefinition(a))
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	cases := map[string]bool{
+		"esu:///sites/website": true,
+		"esu:///sites":         false,
+		"esu:///sites/":        false,
+		"esu:///a/b/c":         false,
+	}
+	for target, valid := range cases {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cluster, service, err := parseTarget(resolver.Target{URL: *u})
+		if valid && (err != nil || cluster != "sites" || service != "website") {
+			t.Errorf("%s parsed as %q %q %v", target, cluster, service, err)
+		} else if !valid && err == nil {
+			t.Errorf("expected error for target %s", target)
+		}
+	}
+}
+
+type recordingConn struct {
+	resolver.ClientConn
+	mu     sync.Mutex
+	addrs  []resolver.Address
+	errors []error
+}
+
+func (c *recordingConn) UpdateState(s resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addrs = s.Addresses
+	return nil
+}
+
+func (c *recordingConn) ReportError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors = append(c.errors, err)
+}
+
+// slowLister blocks each call until released, and records the most calls
+// made at once.
+type slowLister struct {
+	mu      sync.Mutex
+	err     error
+	calls   int
+	active  int
+	maxSeen int
+	release chan bool
+}
+
+func (l *slowLister) Tasks(service string) ([]esu.TaskInfo, error) {
+	l.mu.Lock()
+	l.calls++
+	l.active++
+	if l.active > l.maxSeen {
+		l.maxSeen = l.active
+	}
+	first := l.calls == 1
+	err := l.err
+	l.mu.Unlock()
+	if !first {
+		<-l.release
+	}
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+	return nil, err
+}
+
+func TestResolveNowCoalesces(t *testing.T) {
+	lister := &slowLister{release: make(chan bool)}
+	b := NewBuilderWithLister(func(string) esu.TaskLister { return lister })
+	u, _ := url.Parse("esu:///sites/website")
+	cc := &recordingConn{}
+	r, err := b.Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Once an update is in progress, further calls are coalesced into one.
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		lister.mu.Lock()
+		active := lister.active
+		lister.mu.Unlock()
+		if active == 1 {
+			break
+		}
+	}
+	for i := 0; i < 10; i++ {
+		r.ResolveNow(resolver.ResolveNowOptions{})
+	}
+	lister.release <- true
+	lister.release <- true
+	time.Sleep(20 * time.Millisecond)
+	lister.mu.Lock()
+	defer lister.mu.Unlock()
+	if lister.calls != 3 || lister.maxSeen != 1 {
+		t.Errorf("expected 3 serialized calls, got %d with up to %d at once", lister.calls, lister.maxSeen)
+	}
+}
+
+func TestResolverReportsErrorsUntilResolved(t *testing.T) {
+	lister := &slowLister{err: errors.New("ecs unavailable"), release: make(chan bool, 10)}
+	b := NewBuilderWithLister(func(string) esu.TaskLister { return lister })
+	u, _ := url.Parse("esu:///sites/website")
+	cc := &recordingConn{}
+	r, err := b.Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cc.mu.Lock()
+	if len(cc.errors) != 1 {
+		t.Errorf("expected error before the first resolution, got %v", cc.errors)
+	}
+	cc.mu.Unlock()
+
+	// Errors after a successful update keep the last good addresses.
+	lister.mu.Lock()
+	lister.err = nil
+	lister.mu.Unlock()
+	er := r.(*esuResolver)
+	lister.release <- true
+	er.tm.Update()
+	lister.mu.Lock()
+	lister.err = errors.New("ecs unavailable")
+	lister.mu.Unlock()
+	lister.release <- true
+	er.tm.Update()
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if len(cc.errors) != 1 {
+		t.Errorf("expected transient errors not to be reported, got %v", cc.errors)
+	}
+}
@@ -0,0 +1,170 @@
+// Package hostsfile maintains a managed block in a hosts-format file, such as
+// /etc/hosts, mapping service names to the IPs of their running tasks. It is
+// intended for containers that can't run a DNS resolver.
+//
+// Each running task gets a line mapping "<task-id>.<service>" and "<service>"
+// to its private IP. Content outside the managed block is preserved.
+package hostsfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dpup/esu"
+)
+
+// Markers delimiting the managed block.
+const (
+	BeginMarker = "# BEGIN esu managed block, do not edit"
+	EndMarker   = "# END esu managed block"
+)
+
+// Writer rewrites the managed block whenever a service's tasks change.
+type Writer struct {
+	Path string
+
+	// Domain, if set, is appended to every name, e.g. "internal" results in
+	// "website.internal".
+	Domain string
+
+	OnError func(error)
+
+	writeFile func(path string, data []byte, perm os.FileMode) error
+
+	mu       sync.Mutex
+	monitors map[string]*esu.TaskMonitor
+}
+
+// New returns a writer for the file at path.
+func New(path string) *Writer {
+	return &Writer{
+		Path:      path,
+		writeFile: esu.WriteFileAtomic,
+		monitors:  map[string]*esu.TaskMonitor{},
+	}
+}
+
+// AddService includes a service's running tasks in the managed block, and
+// rewrites the file when they change. The caller is responsible for starting
+// the monitor.
+func (w *Writer) AddService(tm *esu.TaskMonitor) {
+	w.mu.Lock()
+	w.monitors[tm.Service] = tm
+	w.mu.Unlock()
+	tm.AddTaskListener(func([]esu.TaskInfo) {
+		if err := w.Write(); err != nil && w.OnError != nil {
+			w.OnError(err)
+		}
+	})
+}
+
+// Write updates the managed block with the current running tasks. The file is
+// only rewritten if its content changes.
+func (w *Writer) Write() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	services := map[string][]esu.TaskInfo{}
+	for name, tm := range w.monitors {
+		services[name] = tm.RunningTasks()
+	}
+
+	perms := os.FileMode(0644)
+	existing, err := ioutil.ReadFile(w.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if fi, err := os.Stat(w.Path); err == nil {
+		perms = fi.Mode().Perm()
+	}
+
+	updated := ReplaceBlock(existing, Block(services, w.Domain))
+	if bytes.Equal(existing, updated) {
+		return nil
+	}
+	err = w.writeFile(w.Path, updated, perms)
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) && existing != nil {
+		// Bind-mounted files, like /etc/hosts in Docker, can't be replaced by
+		// a rename. Rewriting in place keeps the file's owner and mode.
+		return writeInPlace(w.Path, updated)
+	}
+	return err
+}
+
+// writeInPlace truncates and rewrites an existing file.
+func writeInPlace(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Block renders the managed block, including markers, for the given services.
+// Lines are sorted by service and then IP so output is stable.
+func Block(services map[string][]esu.TaskInfo, domain string) []byte {
+	suffix := ""
+	if domain != "" {
+		suffix = "." + strings.Trim(domain, ".")
+	}
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, BeginMarker)
+	for _, name := range names {
+		tasks := append([]esu.TaskInfo{}, services[name]...)
+		sort.Slice(tasks, func(i, j int) bool { return tasks[i].PrivateIPAddress < tasks[j].PrivateIPAddress })
+		for _, t := range tasks {
+			if t.PrivateIPAddress == "" {
+				continue
+			}
+			hosts := []string{}
+			if id := t.TaskID(); id != "" {
+				hosts = append(hosts, id+"."+name+suffix)
+			}
+			hosts = append(hosts, name+suffix)
+			fmt.Fprintf(&buf, "%s\t%s\n", t.PrivateIPAddress, strings.Join(hosts, " "))
+		}
+	}
+	fmt.Fprintln(&buf, EndMarker)
+	return buf.Bytes()
+}
+
+// ReplaceBlock swaps the managed block in content for block, appending it if
+// content has no managed block.
+func ReplaceBlock(content, block []byte) []byte {
+	begin := bytes.Index(content, []byte(BeginMarker))
+	end := bytes.Index(content, []byte(EndMarker))
+	if begin == -1 || end == -1 || end < begin {
+		var buf bytes.Buffer
+		buf.Write(content)
+		if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		buf.Write(block)
+		return buf.Bytes()
+	}
+	end += len(EndMarker)
+	if end < len(content) && content[end] == '\n' {
+		end++
+	}
+	var buf bytes.Buffer
+	buf.Write(content[:begin])
+	buf.Write(block)
+	buf.Write(content[end:])
+	return buf.Bytes()
+}
@@ -0,0 +1,119 @@
+package hostsfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/dpup/esu"
+)
+
+type fakeLister struct {
+	tasks []esu.TaskInfo
+}
+
+func (f *fakeLister) Tasks(service string) ([]esu.TaskInfo, error) {
+	return f.tasks, nil
+}
+
+func task(id, ip string) esu.TaskInfo {
+	return esu.TaskInfo{
+		TaskARN:          "arn:aws:ecs:us-east-1:12345678:task/" + id,
+		DesiredStatus:    esu.ECSTaskStatusRunning,
+		LastStatus:       esu.ECSTaskStatusRunning,
+		EC2InstanceID:    "i-" + id,
+		PrivateIPAddress: ip,
+		Port:             8080,
+	}
+}
+
+func TestReplaceBlock(t *testing.T) {
+	block := BeginMarker + "\n10.0.0.1\twebsite\n" + EndMarker + "\n"
+	cases := map[string]string{
+		"":                      block,
+		"127.0.0.1\tlocalhost":  "127.0.0.1\tlocalhost\n" + block,
+		"127.0.0.1 localhost\n": "127.0.0.1 localhost\n" + block,
+		"127.0.0.1 localhost\n" + BeginMarker + "\nold\n" + EndMarker + "\n::1 localhost\n": "127.0.0.1 localhost\n" + block + "::1 localhost\n",
+	}
+	for in, expected := range cases {
+		if out := string(ReplaceBlock([]byte(in), []byte(block))); out != expected {
+			t.Errorf("ReplaceBlock(%q) was\n%q, wanted\n%q", in, out, expected)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostsfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1\tlocalhost\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	lister := &fakeLister{tasks: []esu.TaskInfo{task("bbb", "10.0.0.2"), task("aaa", "10.0.0.1")}}
+	tm := esu.NewTaskMonitorWithLister(lister, "website")
+	w := New(path)
+	w.Domain = "internal"
+	w.AddService(tm)
+	tm.Update()
+
+	b, _ := ioutil.ReadFile(path)
+	expected := "127.0.0.1\tlocalhost\n" + BeginMarker + "\n" +
+		"10.0.0.1\taaa.website.internal website.internal\n" +
+		"10.0.0.2\tbbb.website.internal website.internal\n" +
+		EndMarker + "\n"
+	if string(b) != expected {
+		t.Errorf("unexpected hosts file:\n%s", b)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("permissions changed to %s", fi.Mode())
+	}
+
+	// User edits outside the block survive updates.
+	ioutil.WriteFile(path, append(b, []byte("10.1.1.1\tmanual\n")...), 0600)
+	lister.tasks = lister.tasks[1:]
+	tm.Update()
+	b, _ = ioutil.ReadFile(path)
+	expected = "127.0.0.1\tlocalhost\n" + BeginMarker + "\n" +
+		"10.0.0.1\taaa.website.internal website.internal\n" +
+		EndMarker + "\n10.1.1.1\tmanual\n"
+	if string(b) != expected {
+		t.Errorf("unexpected hosts file after update:\n%s", b)
+	}
+}
+
+func TestWriterBindMounted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1\tlocalhost\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tm := esu.NewTaskMonitorWithLister(&fakeLister{tasks: []esu.TaskInfo{task("abc", "10.0.0.1")}}, "website")
+	tm.Update()
+	w := New(path)
+	// Renaming over a bind-mounted file fails with EBUSY.
+	w.writeFile = func(path string, data []byte, perm os.FileMode) error {
+		return &os.LinkError{Op: "rename", Old: path + ".tmp", New: path, Err: syscall.EBUSY}
+	}
+	w.AddService(tm)
+	if err := w.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := ioutil.ReadFile(path)
+	expected := "127.0.0.1\tlocalhost\n" + BeginMarker + "\n10.0.0.1\tabc.website website\n" + EndMarker + "\n"
+	if string(out) != expected {
+		t.Errorf("unexpected file content:\n%s", out)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected mode to be preserved, got %v", fi.Mode())
+	}
+}
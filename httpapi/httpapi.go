@@ -0,0 +1,437 @@
+// Package httpapi serves cached ECS discovery data as JSON, so tooling that
+// can't use the library directly doesn't need to query the ECS API itself.
+//
+//	GET /v1/clusters/{cluster}/services
+//	GET /v1/clusters/{cluster}/services/{service}/tasks?status=running|all
+//	GET /v1/clusters/{cluster}/services/{service}/watch?status=running|all&index=N
+//
+// Services are monitored with a TaskMonitor from the first time they are
+// requested, until they go unrequested for IdleTimeout. The watch endpoint
+// long-polls until the tasks change from the given index, or streams every
+// change as server-sent events if the request accepts "text/event-stream".
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dpup/esu"
+)
+
+// DefaultServicesTTL is how long a cluster's list of services is cached.
+const DefaultServicesTTL = time.Minute
+
+// DefaultWatchTimeout is how long a long-poll waits for a change before
+// returning the current tasks.
+const DefaultWatchTimeout = 60 * time.Second
+
+// DefaultIdleTimeout is how long a service's monitor keeps running after its
+// last request.
+const DefaultIdleTimeout = 10 * time.Minute
+
+// finder is the subset of TaskFinder used by the server.
+type finder interface {
+	esu.TaskLister
+	Services() ([]string, error)
+}
+
+// ServicesResponse is returned by the services endpoint.
+type ServicesResponse struct {
+	Cluster  string   `json:"cluster"`
+	Services []string `json:"services"`
+}
+
+// TasksResponse is returned by the tasks and watch endpoints. Index increases
+// each time the service's tasks change.
+type TasksResponse struct {
+	Cluster     string         `json:"cluster"`
+	Service     string         `json:"service"`
+	Index       uint64         `json:"index"`
+	LastUpdated time.Time      `json:"last_updated"`
+	Tasks       []esu.TaskInfo `json:"tasks"`
+}
+
+// Server is an http.Handler for the discovery API.
+type Server struct {
+	// Clusters restricts which clusters can be queried. If empty, any cluster
+	// may be.
+	Clusters []string
+
+	ServicesTTL  time.Duration
+	WatchTimeout time.Duration
+
+	// IdleTimeout is how long a service is monitored after its last request
+	// finishes. Zero keeps monitors running until Close.
+	IdleTimeout time.Duration
+
+	// OnError is called with errors from background monitors.
+	OnError func(error)
+
+	newFinder func(cluster string) finder
+
+	mu       sync.Mutex
+	clusters map[string]*cluster
+}
+
+type cluster struct {
+	finder   finder
+	services []string
+	fetched  time.Time
+	watched  map[string]*watched
+}
+
+// watched is a monitored service. changed is closed and replaced each time the
+// tasks change, waking any watchers. users and idle are guarded by the
+// server's lock.
+type watched struct {
+	tm      *esu.TaskMonitor
+	once    sync.Once
+	cancel  chan<- bool
+	users   int
+	idle    int
+	mu      sync.Mutex
+	index   uint64
+	changed chan struct{}
+}
+
+// New returns a server that queries ECS using the given session.
+func New(sess *session.Session) *Server {
+	return newServer(func(cluster string) finder {
+		return esu.NewTaskFinder(sess, cluster)
+	})
+}
+
+func newServer(newFinder func(cluster string) finder) *Server {
+	return &Server{
+		ServicesTTL:  DefaultServicesTTL,
+		WatchTimeout: DefaultWatchTimeout,
+		IdleTimeout:  DefaultIdleTimeout,
+		newFinder:    newFinder,
+		clusters:     map[string]*cluster{},
+	}
+}
+
+// Close stops all monitors.
+func (s *Server) Close() {
+	s.mu.Lock()
+	var stopping []*watched
+	for _, c := range s.clusters {
+		for _, w := range c.watched {
+			stopping = append(stopping, w)
+		}
+	}
+	s.clusters = map[string]*cluster{}
+	s.mu.Unlock()
+	for _, w := range stopping {
+		w.stop()
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "v1" || parts[1] != "clusters" || parts[3] != "services" {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+	name := parts[2]
+	if !s.allowed(name) {
+		httpError(w, http.StatusNotFound, "unknown cluster: "+name)
+		return
+	}
+
+	switch {
+	case len(parts) == 4:
+		s.serveServices(w, name)
+	case len(parts) == 6 && parts[5] == "tasks":
+		s.serveTasks(w, r, name, parts[4])
+	case len(parts) == 6 && parts[5] == "watch":
+		s.serveWatch(w, r, name, parts[4])
+	default:
+		httpError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) serveServices(w http.ResponseWriter, name string) {
+	services, err := s.services(name)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, ServicesResponse{Cluster: name, Services: services})
+}
+
+func (s *Server) serveTasks(w http.ResponseWriter, r *http.Request, name, service string) {
+	all, ok := parseStatus(w, r)
+	if !ok || !s.checkService(w, name, service) {
+		return
+	}
+	ws := s.watch(name, service)
+	defer s.release(name, service, ws)
+	writeJSON(w, ws.response(name, service, all))
+}
+
+func (s *Server) serveWatch(w http.ResponseWriter, r *http.Request, name, service string) {
+	all, ok := parseStatus(w, r)
+	if !ok || !s.checkService(w, name, service) {
+		return
+	}
+	ws := s.watch(name, service)
+	defer s.release(name, service, ws)
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.streamEvents(w, r, ws, name, service, all)
+		return
+	}
+
+	var index uint64
+	if v := r.URL.Query().Get("index"); v != "" {
+		i, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "invalid index: "+v)
+			return
+		}
+		index = i
+	}
+	ws.mu.Lock()
+	current, changed := ws.index, ws.changed
+	ws.mu.Unlock()
+	if current <= index {
+		select {
+		case <-changed:
+		case <-time.After(s.WatchTimeout):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	writeJSON(w, ws.response(name, service, all))
+}
+
+// streamEvents writes a server-sent event with the current tasks, and again
+// each time they change, until the client goes away.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, ws *watched, name, service string, all bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for {
+		ws.mu.Lock()
+		changed := ws.changed
+		ws.mu.Unlock()
+		b, err := json.Marshal(ws.response(name, service, all))
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: tasks\ndata: %s\n\n", b)
+		flusher.Flush()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) allowed(name string) bool {
+	if len(s.Clusters) == 0 {
+		return true
+	}
+	for _, c := range s.Clusters {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// cluster returns the state for a cluster. Must be called with the lock held.
+func (s *Server) cluster(name string) *cluster {
+	c, ok := s.clusters[name]
+	if !ok {
+		c = &cluster{finder: s.newFinder(name), watched: map[string]*watched{}}
+		s.clusters[name] = c
+	}
+	return c
+}
+
+// services returns the cached list of service names on a cluster, refreshing
+// it if older than ServicesTTL. ECS is queried outside the server's lock.
+func (s *Server) services(name string) ([]string, error) {
+	s.mu.Lock()
+	c := s.cluster(name)
+	if c.services != nil && time.Since(c.fetched) < s.ServicesTTL {
+		services := c.services
+		s.mu.Unlock()
+		return services, nil
+	}
+	s.mu.Unlock()
+
+	arns, err := c.finder.Services()
+	if err != nil {
+		return nil, err
+	}
+	services := make([]string, len(arns))
+	for i, str := range arns {
+		arn, err := esu.ParseARN(str)
+		if err != nil {
+			return nil, err
+		}
+		services[i] = arn.Name()
+	}
+	s.mu.Lock()
+	c.services = services
+	c.fetched = time.Now()
+	s.mu.Unlock()
+	return services, nil
+}
+
+// checkService writes an error and returns false if the service isn't on the
+// cluster, so monitors are only started for real services.
+func (s *Server) checkService(w http.ResponseWriter, name, service string) bool {
+	services, err := s.services(name)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, err.Error())
+		return false
+	}
+	for _, svc := range services {
+		if svc == service {
+			return true
+		}
+	}
+	httpError(w, http.StatusNotFound, "unknown service: "+service)
+	return false
+}
+
+// watch returns the monitored state of a service, starting a monitor the first
+// time the service is requested. The monitor's first update happens outside
+// the server's lock. Callers must release the service when done with it.
+func (s *Server) watch(name, service string) *watched {
+	s.mu.Lock()
+	c := s.cluster(name)
+	ws, ok := c.watched[service]
+	if !ok {
+		ws = s.newWatched(name, service, c.finder)
+		c.watched[service] = ws
+	}
+	ws.users++
+	s.mu.Unlock()
+	ws.start()
+	return ws
+}
+
+// release marks a request for a service as finished. Once a service has had
+// no requests for IdleTimeout its monitor is stopped.
+func (s *Server) release(name, service string, ws *watched) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ws.users--
+	if ws.users > 0 || s.IdleTimeout <= 0 {
+		return
+	}
+	ws.idle++
+	idle := ws.idle
+	time.AfterFunc(s.IdleTimeout, func() {
+		s.mu.Lock()
+		c, ok := s.clusters[name]
+		if !ok || c.watched[service] != ws || ws.users > 0 || ws.idle != idle {
+			s.mu.Unlock()
+			return
+		}
+		delete(c.watched, service)
+		s.mu.Unlock()
+		// Stopping waits for the monitor to start, so happens outside the
+		// lock.
+		ws.stop()
+	})
+}
+
+func (s *Server) newWatched(name, service string, f finder) *watched {
+	ws := &watched{
+		tm:      esu.NewTaskMonitorWithLister(f, service),
+		changed: make(chan struct{}),
+	}
+	ws.tm.OnStatusChange = func([]esu.TaskInfo) {
+		ws.mu.Lock()
+		ws.index++
+		close(ws.changed)
+		ws.changed = make(chan struct{})
+		ws.mu.Unlock()
+	}
+	ws.tm.OnError = func(err error) {
+		if s.OnError != nil {
+			s.OnError(fmt.Errorf("%s/%s: %s", name, service, err))
+		}
+	}
+	return ws
+}
+
+// start starts the service's monitor, if it isn't already running.
+func (ws *watched) start() {
+	ws.once.Do(func() { ws.cancel = ws.tm.Monitor() })
+}
+
+// stop stops the service's monitor, and stops it from being started. If the
+// monitor is starting, it waits for the first update to finish.
+func (ws *watched) stop() {
+	ws.once.Do(func() {})
+	if ws.cancel != nil {
+		ws.cancel <- true
+	}
+}
+
+func (ws *watched) response(name, service string, all bool) TasksResponse {
+	ws.mu.Lock()
+	index := ws.index
+	ws.mu.Unlock()
+	tasks := ws.tm.RunningTasks()
+	if all {
+		tasks = ws.tm.AllTasks()
+	}
+	if tasks == nil {
+		tasks = []esu.TaskInfo{}
+	}
+	return TasksResponse{
+		Cluster:     name,
+		Service:     service,
+		Index:       index,
+		LastUpdated: ws.tm.LastSuccessfulUpdate(),
+		Tasks:       tasks,
+	}
+}
+
+// parseStatus returns true if all tasks were requested, rather than just
+// running tasks.
+func parseStatus(w http.ResponseWriter, r *http.Request) (all bool, ok bool) {
+	switch status := r.URL.Query().Get("status"); status {
+	case "", "running":
+		return false, true
+	case "all":
+		return true, true
+	default:
+		httpError(w, http.StatusBadRequest, "invalid status: "+status)
+		return false, false
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,243 @@
+package httpapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dpup/esu"
+)
+
+type fakeFinder struct {
+	mu    sync.Mutex
+	tasks []esu.TaskInfo
+	block chan bool
+}
+
+func (f *fakeFinder) Services() ([]string, error) {
+	if f.block != nil {
+		<-f.block
+	}
+	return []string{"arn:aws:ecs:us-east-1:12345678:service/website"}, nil
+}
+
+func (f *fakeFinder) Tasks(service string) ([]esu.TaskInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tasks, nil
+}
+
+func (f *fakeFinder) setTasks(tasks ...esu.TaskInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tasks = tasks
+}
+
+func task(ip string, status esu.ECSTaskStatus) esu.TaskInfo {
+	return esu.TaskInfo{
+		DesiredStatus:    esu.ECSTaskStatusRunning,
+		LastStatus:       status,
+		EC2InstanceID:    "i-" + ip,
+		PrivateIPAddress: ip,
+		Port:             8080,
+	}
+}
+
+func setup(t *testing.T) (*Server, *fakeFinder, *httptest.Server) {
+	f := &fakeFinder{}
+	f.setTasks(task("10.0.0.1", esu.ECSTaskStatusRunning), task("10.0.0.2", esu.ECSTaskStatusPending))
+	s := newServer(func(string) finder { return f })
+	s.Clusters = []string{"sites"}
+	return s, f, httptest.NewServer(s)
+}
+
+func get(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServicesAndTasks(t *testing.T) {
+	s, _, srv := setup(t)
+	defer srv.Close()
+	defer s.Close()
+
+	var services ServicesResponse
+	if code := get(t, srv.URL+"/v1/clusters/sites/services", &services); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(services.Services) != 1 || services.Services[0] != "website" {
+		t.Errorf("unexpected services %v", services.Services)
+	}
+
+	var tasks TasksResponse
+	get(t, srv.URL+"/v1/clusters/sites/services/website/tasks", &tasks)
+	if len(tasks.Tasks) != 1 || tasks.Index != 1 || tasks.LastUpdated.IsZero() {
+		t.Errorf("unexpected running tasks %+v", tasks)
+	}
+	get(t, srv.URL+"/v1/clusters/sites/services/website/tasks?status=all", &tasks)
+	if len(tasks.Tasks) != 2 {
+		t.Errorf("expected 2 tasks with status=all, got %d", len(tasks.Tasks))
+	}
+
+	errorCases := map[string]int{
+		"/v1/clusters/other/services":                           http.StatusNotFound,
+		"/v1/clusters/sites/services/website/tasks?status=nope": http.StatusBadRequest,
+		"/v1/clusters/sites/services/website/bogus":             http.StatusNotFound,
+		"/v1/clusters/sites/services/unknown/tasks":             http.StatusNotFound,
+		"/v1/clusters/sites/services/unknown/watch":             http.StatusNotFound,
+		"/v2/clusters/sites/services":                           http.StatusNotFound,
+	}
+	for path, expected := range errorCases {
+		if code := get(t, srv.URL+path, nil); code != expected {
+			t.Errorf("%s returned %d, wanted %d", path, code, expected)
+		}
+	}
+}
+
+func TestSlowClusterDoesNotBlockOthers(t *testing.T) {
+	slow := &fakeFinder{block: make(chan bool)}
+	fast := &fakeFinder{}
+	s := newServer(func(name string) finder {
+		if name == "slow" {
+			return slow
+		}
+		return fast
+	})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	defer s.Close()
+
+	fetch := func(url string, done chan<- error) {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}
+	go fetch(srv.URL+"/v1/clusters/slow/services", make(chan error, 1))
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan error, 1)
+	go fetch(srv.URL+"/v1/clusters/sites/services", done)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected a slow cluster not to block requests for other clusters")
+	}
+	close(slow.block)
+}
+
+func TestIdleMonitorsStopped(t *testing.T) {
+	s, _, srv := setup(t)
+	defer srv.Close()
+	defer s.Close()
+	s.IdleTimeout = 20 * time.Millisecond
+
+	watching := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.cluster("sites").watched)
+	}
+	get(t, srv.URL+"/v1/clusters/sites/services/unknown/tasks", nil)
+	if n := watching(); n != 0 {
+		t.Errorf("expected unknown service not to be monitored, got %d monitors", n)
+	}
+	get(t, srv.URL+"/v1/clusters/sites/services/website/tasks", nil)
+	if n := watching(); n != 1 {
+		t.Errorf("expected service to be monitored, got %d monitors", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := watching(); n != 0 {
+		t.Errorf("expected idle monitor to be stopped, got %d monitors", n)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	s, f, srv := setup(t)
+	defer srv.Close()
+	defer s.Close()
+	s.WatchTimeout = 50 * time.Millisecond
+
+	// Times out with the current tasks.
+	var tasks TasksResponse
+	get(t, srv.URL+"/v1/clusters/sites/services/website/watch?index=1", &tasks)
+	if tasks.Index != 1 {
+		t.Errorf("expected index 1 after timeout, got %d", tasks.Index)
+	}
+
+	s.WatchTimeout = 5 * time.Second
+	done := make(chan TasksResponse)
+	go func() {
+		var tasks TasksResponse
+		get(t, srv.URL+"/v1/clusters/sites/services/website/watch?index=1", &tasks)
+		done <- tasks
+	}()
+	time.Sleep(50 * time.Millisecond)
+	f.setTasks(task("10.0.0.1", esu.ECSTaskStatusRunning), task("10.0.0.2", esu.ECSTaskStatusRunning))
+	s.watch("sites", "website").tm.Update()
+
+	select {
+	case tasks := <-done:
+		if tasks.Index != 2 || len(tasks.Tasks) != 2 {
+			t.Errorf("unexpected watch response %+v", tasks)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("long poll didn't return after change")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	s, f, srv := setup(t)
+	defer srv.Close()
+	defer s.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/clusters/sites/services/website/watch", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+
+	next := func() TasksResponse {
+		var tasks TasksResponse
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				if err := json.Unmarshal([]byte(line[6:]), &tasks); err != nil {
+					t.Fatal(err)
+				}
+				return tasks
+			}
+		}
+	}
+
+	if tasks := next(); tasks.Index != 1 || len(tasks.Tasks) != 1 {
+		t.Errorf("unexpected initial event %+v", tasks)
+	}
+	f.setTasks()
+	s.watch("sites", "website").tm.Update()
+	if tasks := next(); tasks.Index != 2 || len(tasks.Tasks) != 0 {
+		t.Errorf("unexpected change event %+v", tasks)
+	}
+}
@@ -0,0 +1,128 @@
+package esu
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ImageRef is a container image reference, following the Docker reference
+// grammar:
+//
+//	[registry/]repository[:tag][@digest]
+//
+// For example "12345678.dkr.ecr.us-east-1.amazonaws.com/website:v38" or
+// "localhost:5000/app@sha256:...". References aren't normalized, so String()
+// returns the same form that was parsed.
+type ImageRef struct {
+	Registry   string // Host and optional port, empty for Docker Hub.
+	Repository string
+	Tag        string
+	Digest     string // Algorithm and hex, e.g. "sha256:abc...".
+}
+
+var (
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	registryRegexp      = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*|\[[0-9a-fA-F:]+\])(?::[0-9]+)?$`)
+	tagRegexp           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp        = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[0-9a-fA-F]{32,}$`)
+	ecrRegistryRegexp   = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+)
+
+// ParseImageRef parses an image reference.
+func ParseImageRef(ref string) (ImageRef, error) {
+	var r ImageRef
+	name := ref
+	if i := strings.Index(name, "@"); i != -1 {
+		r.Digest = name[i+1:]
+		name = name[:i]
+		if !digestRegexp.MatchString(r.Digest) {
+			return ImageRef{}, fmt.Errorf("invalid image reference %q, bad digest", ref)
+		}
+	}
+	// A tag can only follow the last path component, so a colon before a slash
+	// is a registry port.
+	if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i:], "/") {
+		r.Tag = name[i+1:]
+		name = name[:i]
+		if !tagRegexp.MatchString(r.Tag) {
+			return ImageRef{}, fmt.Errorf("invalid image reference %q, bad tag", ref)
+		}
+	}
+	if i := strings.Index(name, "/"); i != -1 {
+		if host := name[:i]; strings.ContainsAny(host, ".:") || host == "localhost" || host != strings.ToLower(host) {
+			r.Registry = host
+			name = name[i+1:]
+			if !registryRegexp.MatchString(r.Registry) {
+				return ImageRef{}, fmt.Errorf("invalid image reference %q, bad registry", ref)
+			}
+		}
+	}
+	if name == "" {
+		return ImageRef{}, fmt.Errorf("invalid image reference %q, missing repository", ref)
+	}
+	for _, c := range strings.Split(name, "/") {
+		if !pathComponentRegexp.MatchString(c) {
+			return ImageRef{}, fmt.Errorf("invalid image reference %q, bad repository", ref)
+		}
+	}
+	r.Repository = name
+	return r, nil
+}
+
+// Name returns the registry and repository, without tag or digest.
+func (r ImageRef) Name() string {
+	if r.Registry != "" {
+		return r.Registry + "/" + r.Repository
+	}
+	return r.Repository
+}
+
+// String returns the full reference.
+func (r ImageRef) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// WithTag returns a copy of the reference with the given tag. Any digest is
+// dropped, since it would pin the image regardless of the tag.
+func (r ImageRef) WithTag(tag string) ImageRef {
+	r.Tag = tag
+	r.Digest = ""
+	return r
+}
+
+// WithDigest returns a copy of the reference pinned to the given digest.
+func (r ImageRef) WithDigest(digest string) ImageRef {
+	r.Digest = digest
+	return r
+}
+
+// IsECR returns true if the image is hosted in an ECR registry.
+func (r ImageRef) IsECR() bool {
+	return ecrRegistryRegexp.MatchString(r.Registry)
+}
+
+// ECRAccountID returns the AWS account that owns an ECR registry, or an empty
+// string for other registries.
+func (r ImageRef) ECRAccountID() string {
+	if m := ecrRegistryRegexp.FindStringSubmatch(r.Registry); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// ECRRegion returns the region of an ECR registry, or an empty string for
+// other registries.
+func (r ImageRef) ECRRegion() string {
+	if m := ecrRegistryRegexp.FindStringSubmatch(r.Registry); m != nil {
+		return m[2]
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package esu
+
+import "testing"
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseImageRef(t *testing.T) {
+	cases := map[string]ImageRef{
+		"website":                        {"", "website", "", ""},
+		"website:v38":                    {"", "website", "v38", ""},
+		"library/nginx:1.13-alpine":      {"", "library/nginx", "1.13-alpine", ""},
+		"registry:5000/app":              {"registry:5000", "app", "", ""},
+		"registry:5000/app:tag":          {"registry:5000", "app", "tag", ""},
+		"localhost/app:tag":              {"localhost", "app", "tag", ""},
+		"docker.io/org/team/app:tag":     {"docker.io", "org/team/app", "tag", ""},
+		"[::1]:5000/app":                 {"[::1]:5000", "app", "", ""},
+		"my_app__x.y-z":                  {"", "my_app__x.y-z", "", ""},
+		"app@" + testDigest:              {"", "app", "", testDigest},
+		"app:tag@" + testDigest:          {"", "app", "tag", testDigest},
+		"reg.io:443/a/b:c@" + testDigest: {"reg.io:443", "a/b", "c", testDigest},
+		"12345678.dkr.ecr.us-east-1.amazonaws.com/website:v38": {
+			"12345678.dkr.ecr.us-east-1.amazonaws.com", "website", "v38", ""},
+	}
+	for s, e := range cases {
+		r, err := ParseImageRef(s)
+		if err != nil {
+			t.Errorf("Parse error for %s: %s", s, err)
+			continue
+		}
+		if r != e {
+			t.Errorf("Parse error for %s, wanted %#v was %#v", s, e, r)
+		}
+		if r.String() != s {
+			t.Errorf("String() error, wanted %s, was %s", s, r)
+		}
+	}
+}
+
+func TestParseImageRefInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		":tag",
+		"app:",
+		"App",
+		"app//x",
+		"-app",
+		"app:-tag",
+		"app:tag:more",
+		"registry:5000/",
+		"app@sha256:tooshort",
+		"app@" + testDigest + "x",
+		"bad_host.io/app",
+	}
+	for _, s := range invalid {
+		if r, err := ParseImageRef(s); err == nil {
+			t.Errorf("expected error parsing %q, got %#v", s, r)
+		}
+	}
+}
+
+func TestImageRefHelpers(t *testing.T) {
+	r, _ := ParseImageRef("123456789012.dkr.ecr.eu-west-2.amazonaws.com/team/website:v1@" + testDigest)
+	if !r.IsECR() || r.ECRAccountID() != "123456789012" || r.ECRRegion() != "eu-west-2" {
+		t.Errorf("unexpected ECR details: %v %s %s", r.IsECR(), r.ECRAccountID(), r.ECRRegion())
+	}
+	if s := r.WithTag("v2").String(); s != "123456789012.dkr.ecr.eu-west-2.amazonaws.com/team/website:v2" {
+		t.Errorf("WithTag was %s", s)
+	}
+	if s := r.WithTag("v2").WithDigest(testDigest).Name(); s != "123456789012.dkr.ecr.eu-west-2.amazonaws.com/team/website" {
+		t.Errorf("Name was %s", s)
+	}
+
+	r, _ = ParseImageRef("registry:5000/app")
+	if r.IsECR() || r.ECRAccountID() != "" || r.ECRRegion() != "" {
+		t.Errorf("registry:5000 shouldn't be ECR")
+	}
+}
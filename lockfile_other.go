@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package esu
+
+// lockFile does nothing where flock isn't available, so file locks are best
+// effort.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
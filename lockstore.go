@@ -0,0 +1,157 @@
+package esu
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// NewFileLockStore returns a LockStore that keeps each lock in a file in dir,
+// for deploys run from the same machine. Locks are read and replaced while
+// holding an flock on a companion file, so only one deploy can take over an
+// expired lock. Where flock isn't available, replacing a lock is best effort.
+func NewFileLockStore(dir string) LockStore {
+	return &fileLockStore{dir: dir, now: time.Now}
+}
+
+type fileLockStore struct {
+	dir string
+	now func() time.Time
+}
+
+func (s *fileLockStore) path(key string) string {
+	return filepath.Join(s.dir, strings.Replace(key, "/", ".", -1)+".lock")
+}
+
+// read returns the lock in path, or nil if there isn't one.
+func (s *fileLockStore) read(path string) (*DeployLock, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lock := &DeployLock{}
+	if err := json.Unmarshal(b, lock); err != nil {
+		return nil, propagate(err, "invalid deploy lock "+path)
+	}
+	return lock, nil
+}
+
+func (s *fileLockStore) Acquire(ctx context.Context, lock DeployLock, force bool) error {
+	b, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	path := s.path(lock.Key)
+	unlock, err := lockFile(path + ".flock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current, err := s.read(path)
+	if err != nil {
+		return err
+	}
+	if err := checkLock(current, lock, force, s.now()); err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, b, 0644)
+}
+
+func (s *fileLockStore) Release(ctx context.Context, lock DeployLock) error {
+	path := s.path(lock.Key)
+	unlock, err := lockFile(path + ".flock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current, err := s.read(path)
+	if err != nil || current == nil || current.ID != lock.ID {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DynamoDBStore is a ConditionalStore backed by a DynamoDB table, whose
+// partition key is a string attribute named "Key". Values are stored in a
+// binary attribute named "Value".
+type DynamoDBStore struct {
+	Table string
+
+	db dynamodbiface.DynamoDBAPI
+}
+
+// NewDynamoDBStore returns a store that uses the given table.
+func NewDynamoDBStore(sess *session.Session, table string) *DynamoDBStore {
+	return &DynamoDBStore{Table: table, db: dynamodb.New(sess)}
+}
+
+func dynamoKey(key string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"Key": {S: aws.String(key)}}
+}
+
+// Get implements ConditionalStore.
+func (s *DynamoDBStore) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Table),
+		Key:            dynamoKey(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := resp.Item["Value"]; ok {
+		return v.B, nil
+	}
+	return nil, nil
+}
+
+// Put implements ConditionalStore.
+func (s *DynamoDBStore) Put(ctx context.Context, key string, prev, value []byte) error {
+	item := dynamoKey(key)
+	item["Value"] = &dynamodb.AttributeValue{B: value}
+	in := &dynamodb.PutItemInput{TableName: aws.String(s.Table), Item: item}
+	in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues = dynamoCondition(prev)
+	_, err := s.db.PutItemWithContext(ctx, in)
+	return dynamoError(err)
+}
+
+// Delete implements ConditionalStore.
+func (s *DynamoDBStore) Delete(ctx context.Context, key string, prev []byte) error {
+	in := &dynamodb.DeleteItemInput{TableName: aws.String(s.Table), Key: dynamoKey(key)}
+	in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues = dynamoCondition(prev)
+	_, err := s.db.DeleteItemWithContext(ctx, in)
+	return dynamoError(err)
+}
+
+// dynamoCondition returns a condition expression that requires an item's value
+// to be prev, or the item not to exist if prev is nil.
+func dynamoCondition(prev []byte) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	if prev == nil {
+		return aws.String("attribute_not_exists(#k)"), map[string]*string{"#k": aws.String("Key")}, nil
+	}
+	return aws.String("#v = :prev"),
+		map[string]*string{"#v": aws.String("Value")},
+		map[string]*dynamodb.AttributeValue{":prev": {B: prev}}
+}
+
+func dynamoError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrConditionFailed
+	}
+	return err
+}
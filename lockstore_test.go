@@ -0,0 +1,167 @@
+package esu
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+func testLock(id string, clock *fakeClock) DeployLock {
+	return DeployLock{
+		Key:     "sites/website",
+		ID:      id,
+		Holder:  id + "@laptop",
+		Started: clock.Now(),
+		Expires: clock.Now().Add(time.Minute),
+	}
+}
+
+func TestLockStores(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	stores := map[string]LockStore{
+		"memory": &conditionalLockStore{store: NewMemoryStore(), now: clock.Now},
+		"file":   &fileLockStore{dir: t.TempDir(), now: clock.Now},
+		"dynamo": &conditionalLockStore{store: &DynamoDBStore{Table: "locks", db: &fakeDynamoDB{items: map[string][]byte{}}}, now: clock.Now},
+	}
+	for name, store := range stores {
+		clock.t = time.Unix(1000, 0)
+		ctx := context.Background()
+		alice, bob := testLock("alice", clock), testLock("bob", clock)
+
+		if err := store.Acquire(ctx, alice, false); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		err := store.Acquire(ctx, bob, false)
+		if held, ok := err.(*LockHeldError); !ok || held.Lock.Holder != "alice@laptop" {
+			t.Errorf("%s: expected lock held by alice, was %v", name, err)
+		}
+
+		// Renewing with the same ID succeeds.
+		alice.Expires = alice.Expires.Add(time.Minute)
+		alice.TaskDefinition = TaskDefinitionID{"website", 2}
+		if err := store.Acquire(ctx, alice, false); err != nil {
+			t.Errorf("%s: renew failed: %s", name, err)
+		}
+		clock.t = clock.t.Add(90 * time.Second)
+		err = store.Acquire(ctx, bob, false)
+		if held, ok := err.(*LockHeldError); !ok || held.Lock.TaskDefinition.String() != "website:2" {
+			t.Errorf("%s: expected renewed lock held by alice, was %v", name, err)
+		}
+
+		// Expired locks can be taken.
+		clock.t = clock.t.Add(time.Minute)
+		bob = testLock("bob", clock)
+		if err := store.Acquire(ctx, bob, false); err != nil {
+			t.Errorf("%s: expected expired lock to be taken: %s", name, err)
+		}
+
+		// Releasing someone else's lock does nothing.
+		if err := store.Release(ctx, alice); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+		if err := store.Acquire(ctx, alice, false); err == nil {
+			t.Errorf("%s: expected lock to still be held by bob", name)
+		}
+		if err := store.Acquire(ctx, alice, true); err != nil {
+			t.Errorf("%s: forced acquire failed: %s", name, err)
+		}
+		if err := store.Release(ctx, alice); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+		if err := store.Acquire(ctx, bob, false); err != nil {
+			t.Errorf("%s: expected released lock to be free: %s", name, err)
+		}
+	}
+}
+
+func TestFileLockStoreTakeOver(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	store := &fileLockStore{dir: t.TempDir(), now: clock.Now}
+	ctx := context.Background()
+	if err := store.Acquire(ctx, testLock("alice", clock), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once expired, only one of several deploys takes over the lock.
+	clock.t = clock.t.Add(2 * time.Minute)
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) { errs <- store.Acquire(ctx, testLock(fmt.Sprint("deploy", i), clock), false) }(i)
+	}
+	won := 0
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err == nil {
+			won++
+		} else if _, ok := err.(*LockHeldError); !ok {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("expected one deploy to take over the lock, %d did", won)
+	}
+}
+
+func TestFileLockStoreInvalid(t *testing.T) {
+	store := &fileLockStore{dir: t.TempDir(), now: time.Now}
+	ioutil.WriteFile(store.path("sites/website"), []byte("{"), 0644)
+	if err := store.Acquire(context.Background(), testLock("alice", &fakeClock{time.Now()}), false); err == nil {
+		t.Errorf("expected error for invalid lock file")
+	}
+}
+
+// fakeDynamoDB supports the conditions used by DynamoDBStore.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string][]byte
+}
+
+func (f *fakeDynamoDB) check(key string, cond *string, values map[string]*dynamodb.AttributeValue) error {
+	current, ok := f.items[key]
+	switch aws.StringValue(cond) {
+	case "attribute_not_exists(#k)":
+		if !ok {
+			return nil
+		}
+	case "#v = :prev":
+		if ok && string(current) == string(values[":prev"].B) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unexpected condition %s", aws.StringValue(cond))
+	}
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+func (f *fakeDynamoDB) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	out := &dynamodb.GetItemOutput{}
+	if v, ok := f.items[*in.Key["Key"].S]; ok {
+		out.Item = map[string]*dynamodb.AttributeValue{"Key": in.Key["Key"], "Value": {B: v}}
+	}
+	return out, nil
+}
+
+func (f *fakeDynamoDB) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	key := *in.Item["Key"].S
+	if err := f.check(key, in.ConditionExpression, in.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+	f.items[key] = in.Item["Value"].B
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	key := *in.Key["Key"].S
+	if err := f.check(key, in.ConditionExpression, in.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+	delete(f.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
@@ -0,0 +1,101 @@
+package esu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// Naming templates used when none are configured, matching clusters named
+// "prod-cluster" and task definition families named "prod-website".
+const (
+	DefaultClusterTemplate = "{env}-cluster"
+	DefaultFamilyTemplate  = "{env}-{service}"
+)
+
+// Naming is a convention for deriving cluster names from environments, and
+// task definition families from services. Templates may refer to {env}, and
+// family templates also to {service}.
+type Naming struct {
+	// ClusterTemplate names an environment's cluster. Defaults to
+	// DefaultClusterTemplate.
+	ClusterTemplate string `json:"cluster"`
+
+	// FamilyTemplate names a service's task definition family. Defaults to
+	// DefaultFamilyTemplate.
+	FamilyTemplate string `json:"family"`
+
+	// Clusters maps environments to cluster names, for environments that don't
+	// follow ClusterTemplate.
+	Clusters map[string]string `json:"clusters"`
+
+	// Families maps services to family templates, for services that don't
+	// follow FamilyTemplate.
+	Families map[string]string `json:"families"`
+}
+
+// LoadNaming reads a naming convention from a JSON file, for example:
+//
+//	{
+//	  "cluster": "ecs-{env}",
+//	  "family": "{service}-{env}",
+//	  "clusters": {"prod": "main"},
+//	  "families": {"website": "web-{env}"}
+//	}
+func LoadNaming(path string) (*Naming, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	n := &Naming{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(n); err != nil {
+		return nil, fmt.Errorf("invalid naming config %s: %s", path, err)
+	}
+	return n, nil
+}
+
+// Cluster returns the name of an environment's cluster.
+func (n *Naming) Cluster(env string) (string, error) {
+	if name, ok := n.Clusters[env]; ok {
+		return name, nil
+	}
+	tmpl := n.ClusterTemplate
+	if tmpl == "" {
+		tmpl = DefaultClusterTemplate
+	}
+	return expandName(tmpl, map[string]string{"env": env})
+}
+
+// Family returns the task definition family of a service in an environment.
+func (n *Naming) Family(env, service string) (string, error) {
+	tmpl, ok := n.Families[service]
+	if !ok {
+		tmpl = n.FamilyTemplate
+	}
+	if tmpl == "" {
+		tmpl = DefaultFamilyTemplate
+	}
+	return expandName(tmpl, map[string]string{"env": env, "service": service})
+}
+
+var namePlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// expandName replaces the {placeholders} in a template, returning an error if
+// one is unknown or has no value.
+func expandName(tmpl string, vars map[string]string) (string, error) {
+	var err error
+	name := namePlaceholder.ReplaceAllStringFunc(tmpl, func(p string) string {
+		v, ok := vars[p[1:len(p)-1]]
+		if !ok && err == nil {
+			err = fmt.Errorf("unknown placeholder %s in %q", p, tmpl)
+		} else if v == "" && err == nil {
+			err = fmt.Errorf("no value for %s in %q", p, tmpl)
+		}
+		return v
+	})
+	return name, err
+}
@@ -0,0 +1,70 @@
+package esu
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestNaming(t *testing.T) {
+	n := &Naming{}
+	if c, err := n.Cluster("prod"); c != "prod-cluster" || err != nil {
+		t.Errorf("unexpected default cluster %q %v", c, err)
+	}
+	if f, err := n.Family("prod", "website"); f != "prod-website" || err != nil {
+		t.Errorf("unexpected default family %q %v", f, err)
+	}
+
+	n = &Naming{
+		ClusterTemplate: "ecs-{env}",
+		FamilyTemplate:  "{service}-{env}",
+		Clusters:        map[string]string{"prod": "main"},
+		Families:        map[string]string{"website": "web-{env}", "worker": "worker"},
+	}
+	cases := []struct {
+		env, service, cluster, family string
+	}{
+		{"prod", "api", "main", "api-prod"},
+		{"staging", "api", "ecs-staging", "api-staging"},
+		{"staging", "website", "ecs-staging", "web-staging"},
+		{"staging", "worker", "ecs-staging", "worker"},
+	}
+	for _, c := range cases {
+		cluster, err := n.Cluster(c.env)
+		if cluster != c.cluster || err != nil {
+			t.Errorf("%s: expected cluster %s, was %q %v", c.env, c.cluster, cluster, err)
+		}
+		family, err := n.Family(c.env, c.service)
+		if family != c.family || err != nil {
+			t.Errorf("%s/%s: expected family %s, was %q %v", c.env, c.service, c.family, family, err)
+		}
+	}
+
+	if _, err := n.Cluster(""); err == nil {
+		t.Errorf("expected error without an environment")
+	}
+	if _, err := (&Naming{ClusterTemplate: "{service}"}).Cluster("prod"); err == nil {
+		t.Errorf("expected error for service in cluster template")
+	}
+	if _, err := (&Naming{FamilyTemplate: "{region}-{service}"}).Family("prod", "api"); err == nil {
+		t.Errorf("expected error for unknown placeholder")
+	}
+}
+
+func TestLoadNaming(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "naming.json")
+	ioutil.WriteFile(path, []byte(`{"cluster": "ecs-{env}", "families": {"website": "web"}}`), 0644)
+	n, err := LoadNaming(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.ClusterTemplate != "ecs-{env}" || n.Families["website"] != "web" {
+		t.Errorf("unexpected naming %#v", n)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"clusterTemplate": "ecs-{env}"}`), 0644)
+	if _, err := LoadNaming(path); err == nil {
+		t.Errorf("expected error for unknown field")
+	}
+}
@@ -0,0 +1,172 @@
+// Package promsd exports ECS tasks as Prometheus scrape targets, in the format
+// used by both file_sd_configs and http_sd_configs. This lets Prometheus scrape
+// tasks whose host ports are assigned dynamically.
+package promsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dpup/esu"
+)
+
+// Labels attached to each target.
+const (
+	LabelCluster          = "ecs_cluster"
+	LabelService          = "ecs_service"
+	LabelTaskDefinition   = "ecs_task_definition"
+	LabelInstanceID       = "ec2_instance_id"
+	LabelAvailabilityZone = "availability_zone"
+	labelMetricsPath      = "__metrics_path__"
+)
+
+// TargetGroup is a set of targets sharing labels, as understood by Prometheus.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// finder is the subset of TaskFinder used by the exporter.
+type finder interface {
+	Services() ([]string, error)
+	TasksForPort(service string, containerPort int) ([]esu.TaskInfo, error)
+}
+
+// Exporter queries ECS on Refresh and exposes the results as target groups.
+type Exporter struct {
+	Cluster string
+
+	// Services to export. If empty, all services on the cluster are exported.
+	Services []string
+
+	// MetricsPort is the container port metrics are served on. If zero, the
+	// task's canonical port is used.
+	MetricsPort int
+
+	// MetricsPath overrides the path Prometheus scrapes, if set.
+	MetricsPath string
+
+	finder finder
+
+	mu        sync.RWMutex
+	groups    []TargetGroup
+	byService map[string][]TargetGroup
+}
+
+// New returns an exporter for a cluster.
+func New(sess *session.Session, cluster string) *Exporter {
+	return &Exporter{Cluster: cluster, finder: esu.NewTaskFinder(sess, cluster)}
+}
+
+// Refresh queries ECS for the latest tasks. If a service's tasks can't be
+// listed, its previous target groups are kept and the other services are still
+// refreshed. The first error is returned.
+func (e *Exporter) Refresh() error {
+	services := e.Services
+	if len(services) == 0 {
+		arns, err := e.finder.Services()
+		if err != nil {
+			return err
+		}
+		services = arns
+	}
+	e.mu.RLock()
+	previous := e.byService
+	e.mu.RUnlock()
+
+	var first error
+	groups := []TargetGroup{}
+	byService := map[string][]TargetGroup{}
+	for _, service := range services {
+		name := serviceName(service)
+		tasks, err := e.finder.TasksForPort(name, e.MetricsPort)
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("%s: %s", name, err)
+			}
+			byService[name] = previous[name]
+		} else {
+			byService[name] = e.targetGroups(name, tasks)
+		}
+		groups = append(groups, byService[name]...)
+	}
+	e.mu.Lock()
+	e.groups = groups
+	e.byService = byService
+	e.mu.Unlock()
+	return first
+}
+
+// TargetGroups returns the target groups from the last successful refresh.
+func (e *Exporter) TargetGroups() []TargetGroup {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.groups
+}
+
+// WriteFile atomically writes the target groups to a file for file_sd_configs.
+func (e *Exporter) WriteFile(path string) error {
+	b, err := json.MarshalIndent(e.TargetGroups(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return esu.WriteFileAtomic(path, b, 0644)
+}
+
+// ServeHTTP serves the target groups for http_sd_configs.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	groups := e.TargetGroups()
+	if groups == nil {
+		groups = []TargetGroup{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// targetGroups returns a group per running task, so each target gets its own
+// instance labels. Tasks without a metrics port, or which are being stopped,
+// are skipped.
+func (e *Exporter) targetGroups(service string, tasks []esu.TaskInfo) []TargetGroup {
+	groups := []TargetGroup{}
+	for _, t := range tasks {
+		if t.LastStatus != esu.ECSTaskStatusRunning || t.DesiredStatus != esu.ECSTaskStatusRunning {
+			continue
+		}
+		if t.Port == 0 || t.PrivateIPAddress == "" {
+			continue
+		}
+		labels := map[string]string{
+			LabelCluster:        e.Cluster,
+			LabelService:        service,
+			LabelTaskDefinition: t.TaskDefinition.String(),
+			LabelInstanceID:     t.EC2InstanceID,
+		}
+		if t.AvailabilityZone != "" {
+			labels[LabelAvailabilityZone] = t.AvailabilityZone
+		}
+		if e.MetricsPath != "" {
+			labels[labelMetricsPath] = e.MetricsPath
+		}
+		groups = append(groups, TargetGroup{
+			Targets: []string{net.JoinHostPort(t.PrivateIPAddress, strconv.Itoa(t.Port))},
+			Labels:  labels,
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Targets[0] < groups[j].Targets[0] })
+	return groups
+}
+
+// serviceName returns the name of a service from its ARN. Plain names are
+// returned as is.
+func serviceName(service string) string {
+	if arn, err := esu.ParseARN(service); err == nil {
+		return arn.Name()
+	}
+	return service
+}
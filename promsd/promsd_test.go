@@ -0,0 +1,143 @@
+package promsd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dpup/esu"
+)
+
+type fakeFinder struct {
+	services []string
+	ports    []int
+	err      error
+	failing  map[string]bool
+}
+
+func (f *fakeFinder) Services() ([]string, error) {
+	return f.services, f.err
+}
+
+func (f *fakeFinder) TasksForPort(service string, containerPort int) ([]esu.TaskInfo, error) {
+	f.ports = append(f.ports, containerPort)
+	if f.failing[service] {
+		return nil, errors.New("throttled")
+	}
+	port := 32768
+	if containerPort != 0 {
+		port = 32900
+	}
+	return []esu.TaskInfo{
+		{
+			TaskDefinition:   esu.TaskDefinitionID{Family: service, Revision: 7},
+			DesiredStatus:    esu.ECSTaskStatusRunning,
+			LastStatus:       esu.ECSTaskStatusRunning,
+			Port:             port,
+			EC2InstanceID:    "i-1",
+			PrivateIPAddress: "10.0.0.1",
+			AvailabilityZone: "us-east-1a",
+		},
+		{
+			TaskDefinition:   esu.TaskDefinitionID{Family: service, Revision: 7},
+			DesiredStatus:    esu.ECSTaskStatusRunning,
+			LastStatus:       esu.ECSTaskStatusPending,
+			EC2InstanceID:    "i-2",
+			PrivateIPAddress: "10.0.0.2",
+		},
+		{
+			TaskDefinition:   esu.TaskDefinitionID{Family: service, Revision: 6},
+			DesiredStatus:    esu.ECSTaskStatusStopped,
+			LastStatus:       esu.ECSTaskStatusRunning,
+			Port:             port,
+			EC2InstanceID:    "i-3",
+			PrivateIPAddress: "10.0.0.3",
+		},
+	}, f.err
+}
+
+func TestExporter(t *testing.T) {
+	f := &fakeFinder{services: []string{"arn:aws:ecs:us-east-1:12345678:service/website"}}
+	e := &Exporter{Cluster: "sites", MetricsPort: 9100, MetricsPath: "/internal/metrics", finder: f}
+	if err := e.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []TargetGroup{{
+		Targets: []string{"10.0.0.1:32900"},
+		Labels: map[string]string{
+			LabelCluster:          "sites",
+			LabelService:          "website",
+			LabelTaskDefinition:   "website:7",
+			LabelInstanceID:       "i-1",
+			LabelAvailabilityZone: "us-east-1a",
+			"__metrics_path__":    "/internal/metrics",
+		},
+	}}
+	if !reflect.DeepEqual(e.TargetGroups(), expected) {
+		t.Errorf("unexpected target groups %+v", e.TargetGroups())
+	}
+	if !reflect.DeepEqual(f.ports, []int{9100}) {
+		t.Errorf("expected tasks to be queried for the metrics port, got %v", f.ports)
+	}
+
+	dir, err := ioutil.TempDir("", "promsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets.json")
+	if err := e.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	var fromFile []TargetGroup
+	b, _ := ioutil.ReadFile(path)
+	if err := json.Unmarshal(b, &fromFile); err != nil || !reflect.DeepEqual(fromFile, expected) {
+		t.Errorf("unexpected file contents %s (%v)", b, err)
+	}
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var fromHTTP []TargetGroup
+	if err := json.Unmarshal(w.Body.Bytes(), &fromHTTP); err != nil || !reflect.DeepEqual(fromHTTP, expected) {
+		t.Errorf("unexpected HTTP response %s (%v)", w.Body, err)
+	}
+
+	// Errors keep the previous results.
+	f.err = errors.New("throttled")
+	if err := e.Refresh(); err == nil {
+		t.Error("expected refresh error")
+	}
+	if len(e.TargetGroups()) != 1 {
+		t.Error("expected previous target groups to be kept after an error")
+	}
+}
+
+func TestExporterKeepsFailingService(t *testing.T) {
+	f := &fakeFinder{services: []string{"website", "api"}}
+	e := &Exporter{Cluster: "sites", finder: f}
+	if err := e.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.TargetGroups()); n != 2 {
+		t.Fatalf("expected a target per service, got %d", n)
+	}
+
+	// A failing service keeps its targets while the others are refreshed.
+	f.failing = map[string]bool{"website": true}
+	f.services = []string{"website", "api", "worker"}
+	if err := e.Refresh(); err == nil {
+		t.Error("expected refresh error")
+	}
+	services := []string{}
+	for _, g := range e.TargetGroups() {
+		services = append(services, g.Labels[LabelService])
+	}
+	if !reflect.DeepEqual(services, []string{"website", "api", "worker"}) {
+		t.Errorf("expected targets for every service, got %v", services)
+	}
+}
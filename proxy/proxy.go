@@ -0,0 +1,384 @@
+// Package proxy forwards HTTP requests and raw TCP connections to the running
+// tasks of an ECS service, for sidecar style deployments where a local port
+// stands in for the service.
+//
+// When a task disappears from the monitor's running tasks, no new requests are
+// sent to it and in-flight requests and connections are given DrainTimeout to
+// finish before being closed.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dpup/esu"
+)
+
+// DefaultDrainTimeout is how long in-flight work is given to finish once a task
+// is no longer running.
+const DefaultDrainTimeout = 30 * time.Second
+
+// DefaultDialTimeout is how long to wait when connecting to a task.
+const DefaultDialTimeout = 5 * time.Second
+
+// maxDialAttempts is how many tasks a TCP connection is tried on before giving
+// up.
+const maxDialAttempts = 3
+
+// BackendStats contains counters for a single task.
+type BackendStats struct {
+	Address  string `json:"address"`
+	Active   int    `json:"active"`
+	Total    uint64 `json:"total"`
+	Errors   uint64 `json:"errors"`
+	Draining bool   `json:"draining"`
+}
+
+// Proxy forwards traffic to tasks chosen by a balancer.
+type Proxy struct {
+	Service      string
+	DrainTimeout time.Duration
+	DialTimeout  time.Duration
+
+	balancer *esu.Balancer
+	reverse  *httputil.ReverseProxy
+
+	mu       sync.Mutex
+	backends map[string]*backend
+}
+
+// backend tracks stats and in-flight work for a task.
+type backend struct {
+	stats     BackendStats
+	active    map[*activeConn]bool
+	live      bool
+	transport *http.Transport
+
+	// timer fires DrainTimeout after the task stopped running.
+	timer *time.Timer
+
+	// drained is set once DrainTimeout has passed, and the backend is removed
+	// as soon as its last connection ends.
+	drained bool
+}
+
+// activeConn is an in-flight request or connection, which can be closed if
+// draining takes too long.
+type activeConn struct {
+	close func()
+}
+
+// New returns a proxy for the monitor's service. Tasks are chosen using the
+// given policy and the proxy is kept up to date via a task listener on the
+// monitor.
+func New(tm *esu.TaskMonitor, policy esu.BalancerPolicy) *Proxy {
+	p := &Proxy{
+		Service:      tm.Service,
+		DrainTimeout: DefaultDrainTimeout,
+		DialTimeout:  DefaultDialTimeout,
+		backends:     map[string]*backend{},
+	}
+	p.balancer = esu.NewBalancer(tm, policy)
+	tm.AddTaskListener(p.update)
+	p.update(tm.RunningTasks())
+	p.reverse = &httputil.ReverseProxy{
+		Director:  func(r *http.Request) { r.URL.Scheme = "http" },
+		Transport: roundTripper{p},
+	}
+	return p
+}
+
+// Stats returns counters for each task the proxy has seen, including tasks
+// which are draining.
+func (p *Proxy) Stats() []BackendStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]BackendStats, 0, len(p.backends))
+	for _, b := range p.backends {
+		s := b.stats
+		s.Active = len(b.active)
+		s.Draining = !b.live
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Address < stats[j].Address })
+	return stats
+}
+
+// ServeHTTP forwards the request to a running task.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.reverse.ServeHTTP(w, r)
+}
+
+// ServeTCP accepts connections from the listener and forwards them to running
+// tasks, until the listener is closed.
+func (p *Proxy) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.forward(conn)
+	}
+}
+
+// forward copies data between a client connection and a task.
+func (p *Proxy) forward(client net.Conn) {
+	defer client.Close()
+	var tried []esu.TaskInfo
+	for attempt := 0; attempt < maxDialAttempts; attempt++ {
+		sel, err := p.balancer.PickExcluding(tried...)
+		if err != nil {
+			return
+		}
+		addr := sel.Task.PrivateAddress()
+		upstream, err := net.DialTimeout("tcp", addr, p.DialTimeout)
+		if err != nil {
+			p.recordError(addr, true)
+			sel.Done(err)
+			tried = append(tried, sel.Task)
+			continue
+		}
+		ac := &activeConn{close: func() {
+			client.Close()
+			upstream.Close()
+		}}
+		if _, ok := p.begin(addr, ac); !ok {
+			upstream.Close()
+			sel.Done(nil)
+			tried = append(tried, sel.Task)
+			continue
+		}
+		done := make(chan bool, 2)
+		go func() {
+			io.Copy(upstream, client)
+			if tcp, ok := upstream.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+			}
+			done <- true
+		}()
+		go func() {
+			io.Copy(client, upstream)
+			if tcp, ok := client.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+			}
+			done <- true
+		}()
+		<-done
+		<-done
+		upstream.Close()
+		p.end(addr, ac)
+		sel.Done(nil)
+		return
+	}
+}
+
+// update is called when the set of running tasks changes. Tasks which are no
+// longer running are drained.
+func (p *Proxy) update(tasks []esu.TaskInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	live := map[string]bool{}
+	for _, t := range tasks {
+		addr := t.PrivateAddress()
+		live[addr] = true
+		b := p.backend(addr)
+		b.live = true
+		b.drained = false
+		if b.timer != nil {
+			b.timer.Stop()
+			b.timer = nil
+		}
+	}
+	for addr, b := range p.backends {
+		if live[addr] || !b.live {
+			continue
+		}
+		b.live = false
+		b.transport.CloseIdleConnections()
+		p.drain(addr, b)
+	}
+}
+
+// drain waits for in-flight work on a task to finish, closing anything left
+// after DrainTimeout. Must be called with the lock held.
+func (p *Proxy) drain(addr string, b *backend) {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(p.DrainTimeout, func() {
+		p.mu.Lock()
+		if p.backends[addr] != b || b.live || b.timer != timer {
+			p.mu.Unlock()
+			return
+		}
+		b.timer = nil
+		var conns []*activeConn
+		for ac := range b.active {
+			conns = append(conns, ac)
+		}
+		if len(conns) == 0 {
+			delete(p.backends, addr)
+			b.transport.CloseIdleConnections()
+		} else {
+			b.drained = true
+		}
+		p.mu.Unlock()
+		for _, ac := range conns {
+			ac.close()
+		}
+	})
+	b.timer = timer
+}
+
+// backend returns the stats for an address, creating them if necessary. Must
+// be called with the lock held.
+func (p *Proxy) backend(addr string) *backend {
+	b, ok := p.backends[addr]
+	if !ok {
+		b = &backend{
+			stats:     BackendStats{Address: addr},
+			active:    map[*activeConn]bool{},
+			transport: p.newTransport(),
+		}
+		p.backends[addr] = b
+	}
+	return b
+}
+
+// newTransport returns the HTTP transport used for a single task, so that its
+// idle connections can be closed when the task stops.
+func (p *Proxy) newTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := net.Dialer{Timeout: p.DialTimeout}
+			return d.DialContext(ctx, network, addr)
+		},
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// begin tracks a new connection to a task. It returns false if the task has
+// already been drained, in which case the connection shouldn't be used.
+func (p *Proxy) begin(addr string, ac *activeConn) (*http.Transport, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.backends[addr]
+	if !ok || b.drained {
+		return nil, false
+	}
+	b.stats.Total++
+	b.active[ac] = true
+	return b.transport, true
+}
+
+func (p *Proxy) end(addr string, ac *activeConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.backends[addr]; ok {
+		delete(b.active, ac)
+		if b.drained && len(b.active) == 0 {
+			delete(p.backends, addr)
+			b.transport.CloseIdleConnections()
+		}
+	}
+}
+
+// recordError counts a failed connection to a task, unless it has been
+// drained.
+func (p *Proxy) recordError(addr string, attempt bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.backends[addr]; ok {
+		if attempt {
+			b.stats.Total++
+		}
+		b.stats.Errors++
+	}
+}
+
+// roundTripper sends HTTP requests to a task chosen by the proxy's balancer.
+type roundTripper struct {
+	p *Proxy
+}
+
+// RoundTrip sends the request to a task. If connecting to the task fails, the
+// task is ejected and the request is retried on another task.
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	p := rt.p
+	var tried []esu.TaskInfo
+	var lastErr error
+	for attempt := 0; attempt < maxDialAttempts; attempt++ {
+		sel, err := p.balancer.PickExcluding(tried...)
+		if err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+		tried = append(tried, sel.Task)
+		addr := sel.Task.PrivateAddress()
+		ctx, cancel := context.WithCancel(req.Context())
+		out := req.Clone(ctx)
+		out.URL.Host = addr
+		if req.Body != nil && req.Body != http.NoBody {
+			// The body isn't read until the connection is made, so after a
+			// dial error it can be sent again as long as it wasn't closed.
+			out.Body = ioutil.NopCloser(req.Body)
+		}
+
+		ac := &activeConn{close: cancel}
+		transport, ok := p.begin(addr, ac)
+		if !ok {
+			// The task was drained after it was picked.
+			cancel()
+			sel.Done(nil)
+			lastErr = fmt.Errorf("task %s has stopped", addr)
+			continue
+		}
+		resp, err := transport.RoundTrip(out)
+		if err != nil {
+			p.end(addr, ac)
+			cancel()
+			p.recordError(addr, false)
+			var opErr *net.OpError
+			if !errors.As(err, &opErr) || opErr.Op != "dial" {
+				sel.Done(nil)
+				return nil, err
+			}
+			sel.Done(err)
+			lastErr = err
+			continue
+		}
+		resp.Body = &trackedBody{ReadCloser: resp.Body, done: func() {
+			p.end(addr, ac)
+			cancel()
+			sel.Done(nil)
+		}}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// trackedBody ends an in-flight request when the response body is closed.
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dpup/esu"
+)
+
+type fakeLister struct {
+	tasks []esu.TaskInfo
+}
+
+func (f *fakeLister) Tasks(service string) ([]esu.TaskInfo, error) {
+	return f.tasks, nil
+}
+
+func taskFor(t *testing.T, addr string) esu.TaskInfo {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return esu.TaskInfo{
+		DesiredStatus:    esu.ECSTaskStatusRunning,
+		LastStatus:       esu.ECSTaskStatusRunning,
+		EC2InstanceID:    "i-" + addr,
+		PrivateIPAddress: host,
+		Port:             p,
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from " + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	lister := &fakeLister{tasks: []esu.TaskInfo{taskFor(t, backend.Listener.Addr().String())}}
+	tm := esu.NewTaskMonitorWithLister(lister, "website")
+	tm.Update()
+	p := New(tm, esu.RoundRobin)
+
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello from /index" {
+		t.Errorf("unexpected response %q", body)
+	}
+
+	stats := p.Stats()
+	if len(stats) != 1 || stats[0].Total != 1 || stats[0].Active != 0 || stats[0].Errors != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	lister.tasks = nil
+	tm.Update()
+	resp, err = http.Get(front.URL + "/index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected bad gateway with no tasks, was %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPProxyRetriesDialErrors(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	lister := &fakeLister{tasks: []esu.TaskInfo{
+		taskFor(t, deadAddr),
+		taskFor(t, backend.Listener.Addr().String()),
+	}}
+	tm := esu.NewTaskMonitorWithLister(lister, "website")
+	tm.Update()
+	p := New(tm, esu.RoundRobin)
+
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Post(front.URL, "text/plain", strings.NewReader("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "ping" {
+			t.Errorf("request %d: expected retry on the live task, got %d %q", i, resp.StatusCode, body)
+		}
+	}
+	for _, s := range p.Stats() {
+		if s.Address == deadAddr && s.Errors == 0 {
+			t.Errorf("expected dial errors to be recorded, got %+v", s)
+		}
+	}
+}
+
+func TestTCPProxyDrains(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	lister := &fakeLister{tasks: []esu.TaskInfo{taskFor(t, echo.Addr().String())}}
+	tm := esu.NewTaskMonitorWithLister(lister, "echo")
+	tm.Update()
+	p := New(tm, esu.RoundRobin)
+	p.DrainTimeout = 50 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go p.ServeTCP(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("ping\n"))
+	line, err := r.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("unexpected echo %q %v", line, err)
+	}
+
+	// Removing the task keeps the connection open while draining, then closes it.
+	lister.tasks = nil
+	tm.Update()
+	stats := p.Stats()
+	if len(stats) != 1 || !stats[0].Draining || stats[0].Active != 1 {
+		t.Errorf("expected one draining backend with an active connection, got %+v", stats)
+	}
+	conn.Write([]byte("pong\n"))
+	if line, err := r.ReadString('\n'); err != nil || line != "pong\n" {
+		t.Errorf("connection should work while draining, got %q %v", line, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected connection to be closed after draining, got %v", err)
+	}
+	// The backend is removed once the closed connection has finished.
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.Stats()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := p.Stats(); len(stats) != 0 {
+		t.Errorf("expected drained backend to be removed, got %+v", stats)
+	}
+}
+
+func TestDrainedBackendNotResurrected(t *testing.T) {
+	lister := &fakeLister{tasks: []esu.TaskInfo{taskFor(t, "10.0.0.1:80")}}
+	tm := esu.NewTaskMonitorWithLister(lister, "website")
+	tm.Update()
+	p := New(tm, esu.RoundRobin)
+	p.DrainTimeout = time.Millisecond
+
+	ac := &activeConn{close: func() {}}
+	if _, ok := p.begin("10.0.0.1:80", ac); !ok {
+		t.Fatal("expected live backend to accept connections")
+	}
+	lister.tasks = nil
+	tm.Update()
+	time.Sleep(20 * time.Millisecond)
+
+	// The drained backend stays until its last connection ends.
+	if stats := p.Stats(); len(stats) != 1 || stats[0].Active != 1 {
+		t.Errorf("expected drained backend with an active connection, got %+v", stats)
+	}
+	if _, ok := p.begin("10.0.0.1:80", &activeConn{close: func() {}}); ok {
+		t.Error("expected drained backend to refuse new connections")
+	}
+	p.end("10.0.0.1:80", ac)
+	if _, ok := p.begin("10.0.0.1:80", &activeConn{close: func() {}}); ok {
+		t.Error("expected removed backend not to be recreated")
+	}
+	if stats := p.Stats(); len(stats) != 0 {
+		t.Errorf("expected drained backend to be removed, got %+v", stats)
+	}
+}
+
+func TestRemovingAgainRestartsDrain(t *testing.T) {
+	lister := &fakeLister{tasks: []esu.TaskInfo{taskFor(t, "10.0.0.1:80")}}
+	tm := esu.NewTaskMonitorWithLister(lister, "website")
+	tm.Update()
+	p := New(tm, esu.RoundRobin)
+	p.DrainTimeout = 200 * time.Millisecond
+
+	var closed int32
+	ac := &activeConn{close: func() { atomic.StoreInt32(&closed, 1) }}
+	if _, ok := p.begin("10.0.0.1:80", ac); !ok {
+		t.Fatal("expected live backend to accept connections")
+	}
+	task := lister.tasks
+	lister.tasks = nil
+	tm.Update()
+	lister.tasks = task
+	tm.Update()
+	time.Sleep(100 * time.Millisecond)
+	lister.tasks = nil
+	tm.Update()
+
+	// The first removal's timer would have fired by now.
+	time.Sleep(150 * time.Millisecond)
+	if atomic.LoadInt32(&closed) != 0 {
+		t.Error("expected connection to drain for DrainTimeout after the latest removal")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&closed) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&closed) == 0 {
+		t.Error("expected connection to be closed after draining")
+	}
+}
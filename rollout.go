@@ -0,0 +1,234 @@
+package esu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// Deployment statuses, as reported by ECS. There is one PRIMARY deployment,
+// for the service's current task definition, and an ACTIVE deployment for
+// each older task definition that still has tasks.
+const (
+	DeploymentStatusPrimary = "PRIMARY"
+	DeploymentStatusActive  = "ACTIVE"
+)
+
+// DeploymentState summarizes one of an ECS service's deployments.
+type DeploymentState struct {
+	ID                 string
+	Status             string
+	TaskDefinition     TaskDefinitionID
+	DesiredCount       int
+	RunningCount       int
+	PendingCount       int
+	FailedTasks        int
+	RolloutState       string // IN_PROGRESS, COMPLETED or FAILED
+	RolloutStateReason string
+}
+
+func (s DeploymentState) String() string {
+	str := fmt.Sprintf("%s %s running %d/%d", s.Status, s.TaskDefinition, s.RunningCount, s.DesiredCount)
+	if s.PendingCount > 0 {
+		str += fmt.Sprintf(", pending %d", s.PendingCount)
+	}
+	if s.FailedTasks > 0 {
+		str += fmt.Sprintf(", failed %d", s.FailedTasks)
+	}
+	if s.RolloutState != "" {
+		str += " (" + s.RolloutState + ")"
+	}
+	return str
+}
+
+// deploymentStates returns the states of a service's deployments, primary
+// first.
+func deploymentStates(svc *ecs.Service) ([]DeploymentState, error) {
+	states := make([]DeploymentState, len(svc.Deployments))
+	for i, d := range svc.Deployments {
+		id, err := ParseTaskDefinitionID(aws.StringValue(d.TaskDefinition))
+		if err != nil {
+			return nil, err
+		}
+		states[i] = DeploymentState{
+			ID:                 aws.StringValue(d.Id),
+			Status:             aws.StringValue(d.Status),
+			TaskDefinition:     id,
+			DesiredCount:       int(aws.Int64Value(d.DesiredCount)),
+			RunningCount:       int(aws.Int64Value(d.RunningCount)),
+			PendingCount:       int(aws.Int64Value(d.PendingCount)),
+			FailedTasks:        int(aws.Int64Value(d.FailedTasks)),
+			RolloutState:       aws.StringValue(d.RolloutState),
+			RolloutStateReason: aws.StringValue(d.RolloutStateReason),
+		}
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		return states[i].Status == DeploymentStatusPrimary && states[j].Status != DeploymentStatusPrimary
+	})
+	return states, nil
+}
+
+// deploymentCreated returns when the service's primary deployment of a task
+// definition was created, or zero if it has none.
+func deploymentCreated(svc *ecs.Service, taskDef TaskDefinitionID) time.Time {
+	for _, d := range svc.Deployments {
+		id, err := ParseTaskDefinitionID(aws.StringValue(d.TaskDefinition))
+		if err == nil && id == taskDef && aws.StringValue(d.Status) == DeploymentStatusPrimary {
+			return realTime(d.CreatedAt)
+		}
+	}
+	return time.Time{}
+}
+
+// rolloutStatus checks whether the deployment of a task definition has
+// finished. It is complete once the task definition is the primary deployment,
+// its desired count is met, nothing is pending, no older deployments remain,
+// and ECS doesn't report the rollout as still in progress. An error is
+// returned if ECS reports that the rollout failed or another task definition
+// has become primary.
+func rolloutStatus(states []DeploymentState, taskDef TaskDefinitionID) (bool, error) {
+	if len(states) == 0 {
+		return false, nil
+	}
+	primary := states[0]
+	if primary.Status != DeploymentStatusPrimary {
+		return false, nil
+	}
+	if primary.TaskDefinition != taskDef {
+		return false, fmt.Errorf("%s was replaced by %s", taskDef, primary.TaskDefinition)
+	}
+	switch primary.RolloutState {
+	case ecs.DeploymentRolloutStateFailed:
+		return false, &RolloutFailedError{TaskDefinition: taskDef, Reason: primary.RolloutStateReason}
+	case ecs.DeploymentRolloutStateInProgress:
+		return false, nil
+	}
+	return len(states) == 1 &&
+		primary.RunningCount >= primary.DesiredCount &&
+		primary.PendingCount == 0, nil
+}
+
+// RolloutFailedError is returned when ECS reports a deployment as failed, for
+// example when the deployment circuit breaker trips.
+type RolloutFailedError struct {
+	TaskDefinition TaskDefinitionID
+	Reason         string
+}
+
+func (e *RolloutFailedError) Error() string {
+	return fmt.Sprintf("rollout of %s failed: %s", e.TaskDefinition, e.Reason)
+}
+
+// eventTracker returns service events that haven't been seen before, oldest
+// first.
+type eventTracker map[string]bool
+
+func (t eventTracker) unseen(events []*ecs.ServiceEvent) []string {
+	messages := []string{}
+	for i := len(events) - 1; i >= 0; i-- {
+		id := aws.StringValue(events[i].Id)
+		if !t[id] {
+			t[id] = true
+			messages = append(messages, aws.StringValue(events[i].Message))
+		}
+	}
+	return messages
+}
+
+func describeDeployments(states []DeploymentState) string {
+	strs := make([]string, len(states))
+	for i, s := range states {
+		strs[i] = s.String()
+	}
+	return strings.Join(strs, "; ")
+}
+
+// StoppedTask describes a task that stopped during a deploy.
+type StoppedTask struct {
+	TaskARN        string
+	TaskDefinition TaskDefinitionID
+	StopCode       string
+	StoppedReason  string
+	CreatedAt      time.Time
+	StoppedAt      time.Time
+
+	// Exit codes and reasons reported for containers, keyed by name.
+	ExitCodes        map[string]int
+	ContainerReasons map[string]string
+}
+
+// TaskID returns the ID portion of the task's ARN.
+func (t StoppedTask) TaskID() string {
+	return TaskInfo{TaskARN: t.TaskARN}.TaskID()
+}
+
+// String describes why the task stopped, for example "abc123 Essential
+// container in task exited, website exited 1 (OutOfMemoryError)".
+func (t StoppedTask) String() string {
+	names := []string{}
+	for name := range t.ExitCodes {
+		names = append(names, name)
+	}
+	for name := range t.ContainerReasons {
+		if _, ok := t.ExitCodes[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	str := fmt.Sprintf("%s %s", t.TaskID(), t.StoppedReason)
+	for _, name := range names {
+		str += ", " + name
+		if code, ok := t.ExitCodes[name]; ok {
+			str += fmt.Sprintf(" exited %d", code)
+		}
+		if reason := t.ContainerReasons[name]; reason != "" {
+			str += " (" + reason + ")"
+		}
+	}
+	return str
+}
+
+func newStoppedTask(t *ecs.Task) (StoppedTask, error) {
+	id, err := ParseTaskDefinitionID(aws.StringValue(t.TaskDefinitionArn))
+	if err != nil {
+		return StoppedTask{}, err
+	}
+	st := StoppedTask{
+		TaskARN:          aws.StringValue(t.TaskArn),
+		TaskDefinition:   id,
+		StopCode:         aws.StringValue(t.StopCode),
+		StoppedReason:    aws.StringValue(t.StoppedReason),
+		CreatedAt:        realTime(t.CreatedAt),
+		StoppedAt:        realTime(t.StoppedAt),
+		ExitCodes:        map[string]int{},
+		ContainerReasons: map[string]string{},
+	}
+	for _, c := range t.Containers {
+		if c.ExitCode != nil {
+			st.ExitCodes[aws.StringValue(c.Name)] = int(*c.ExitCode)
+		}
+		if c.Reason != nil {
+			st.ContainerReasons[aws.StringValue(c.Name)] = *c.Reason
+		}
+	}
+	return st, nil
+}
+
+// CrashLoopError is returned when too many tasks of a new revision stop
+// during a deploy.
+type CrashLoopError struct {
+	TaskDefinition TaskDefinitionID
+	Stopped        []StoppedTask
+}
+
+func (e *CrashLoopError) Error() string {
+	strs := make([]string, len(e.Stopped))
+	for i, t := range e.Stopped {
+		strs[i] = t.String()
+	}
+	return fmt.Sprintf("%d tasks of %s stopped: %s", len(e.Stopped), e.TaskDefinition, strings.Join(strs, "; "))
+}
@@ -0,0 +1,38 @@
+package esu
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// snapshot is the on-disk format used to persist a monitor's tasks between
+// process restarts.
+type snapshot struct {
+	Service string     `json:"service"`
+	SavedAt time.Time  `json:"saved_at"`
+	Tasks   []TaskInfo `json:"tasks"`
+}
+
+// readSnapshot loads a snapshot from disk.
+func readSnapshot(path string) (*snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, propagate(err, "decoding snapshot "+path)
+	}
+	return &s, nil
+}
+
+// writeSnapshot persists a snapshot to disk, replacing any existing file
+// atomically so a crash never leaves a partial snapshot behind.
+func writeSnapshot(path string, s *snapshot) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, b, 0644)
+}
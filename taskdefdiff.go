@@ -0,0 +1,149 @@
+package esu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// TaskDefinitionChange is a difference between two task definitions.
+type TaskDefinitionChange struct {
+	// Container is the name of the container the change applies to, or empty
+	// for task level settings.
+	Container string
+
+	// Field that changed, e.g. "image", "cpu" or "env FOO".
+	Field string
+
+	// Old and New values, empty if the field was added or removed.
+	Old string
+	New string
+}
+
+func (c TaskDefinitionChange) String() string {
+	field := c.Field
+	if c.Container != "" {
+		field = c.Container + " " + field
+	}
+	return fmt.Sprintf("%s: %s -> %s", field, orNone(c.Old), orNone(c.New))
+}
+
+// DiffTaskDefinitions compares the settings most likely to matter when
+// deploying, such as images, environment variables, CPU, memory and ports,
+// and returns what changed between them. Containers are matched by name.
+func DiffTaskDefinitions(from, to *ecs.RegisterTaskDefinitionInput) []TaskDefinitionChange {
+	changes := []TaskDefinitionChange{}
+	add := func(container, field, o, n string) {
+		if o != n {
+			changes = append(changes, TaskDefinitionChange{container, field, o, n})
+		}
+	}
+
+	add("", "family", aws.StringValue(from.Family), aws.StringValue(to.Family))
+	add("", "cpu", aws.StringValue(from.Cpu), aws.StringValue(to.Cpu))
+	add("", "memory", aws.StringValue(from.Memory), aws.StringValue(to.Memory))
+	add("", "network mode", aws.StringValue(from.NetworkMode), aws.StringValue(to.NetworkMode))
+	add("", "task role", aws.StringValue(from.TaskRoleArn), aws.StringValue(to.TaskRoleArn))
+	add("", "execution role", aws.StringValue(from.ExecutionRoleArn), aws.StringValue(to.ExecutionRoleArn))
+
+	oldContainers := containersByName(from.ContainerDefinitions)
+	newContainers := containersByName(to.ContainerDefinitions)
+	for _, name := range mergeKeys(containerNames(from), containerNames(to)) {
+		o, n := oldContainers[name], newContainers[name]
+		if o == nil || n == nil {
+			add(name, "container", describeContainer(o), describeContainer(n))
+			continue
+		}
+		add(name, "image", aws.StringValue(o.Image), aws.StringValue(n.Image))
+		add(name, "cpu", int64String(o.Cpu), int64String(n.Cpu))
+		add(name, "memory", int64String(o.Memory), int64String(n.Memory))
+		add(name, "memory reservation", int64String(o.MemoryReservation), int64String(n.MemoryReservation))
+		add(name, "essential", boolString(o.Essential), boolString(n.Essential))
+		add(name, "command", strings.Join(aws.StringValueSlice(o.Command), " "), strings.Join(aws.StringValueSlice(n.Command), " "))
+		add(name, "ports", describePorts(o.PortMappings), describePorts(n.PortMappings))
+
+		oldEnv, newEnv := environment(o), environment(n)
+		for _, key := range mergeKeys(sortedKeys(oldEnv), sortedKeys(newEnv)) {
+			add(name, "env "+key, oldEnv[key], newEnv[key])
+		}
+	}
+	return changes
+}
+
+func containersByName(defs []*ecs.ContainerDefinition) map[string]*ecs.ContainerDefinition {
+	m := map[string]*ecs.ContainerDefinition{}
+	for _, c := range defs {
+		m[aws.StringValue(c.Name)] = c
+	}
+	return m
+}
+
+func environment(c *ecs.ContainerDefinition) map[string]string {
+	m := map[string]string{}
+	for _, kv := range c.Environment {
+		m[aws.StringValue(kv.Name)] = aws.StringValue(kv.Value)
+	}
+	return m
+}
+
+func containerNames(def *ecs.RegisterTaskDefinitionInput) []string {
+	names := make([]string, len(def.ContainerDefinitions))
+	for i, c := range def.ContainerDefinitions {
+		names[i] = aws.StringValue(c.Name)
+	}
+	return names
+}
+
+// mergeKeys returns the distinct keys from a and b, sorted.
+func mergeKeys(a, b []string) []string {
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, k := range append(append([]string{}, a...), b...) {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func describeContainer(c *ecs.ContainerDefinition) string {
+	if c == nil {
+		return ""
+	}
+	return aws.StringValue(c.Image)
+}
+
+func describePorts(mappings []*ecs.PortMapping) string {
+	ports := make([]string, len(mappings))
+	for i, m := range mappings {
+		ports[i] = fmt.Sprintf("%d->%d/%s", aws.Int64Value(m.ContainerPort), aws.Int64Value(m.HostPort), aws.StringValue(m.Protocol))
+	}
+	sort.Strings(ports)
+	return strings.Join(ports, ",")
+}
+
+func int64String(i *int64) string {
+	if i == nil {
+		return ""
+	}
+	return fmt.Sprint(*i)
+}
+
+func boolString(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return fmt.Sprint(*b)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
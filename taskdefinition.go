@@ -0,0 +1,147 @@
+package esu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// TaskDefinitionID identifies a revision of a task definition, as written in
+// short form "family:revision". A zero revision refers to the latest active
+// revision of the family.
+type TaskDefinitionID struct {
+	Family   string
+	Revision int
+}
+
+// ParseTaskDefinitionID parses a "family:revision" short name, a bare family,
+// or a full task definition ARN.
+func ParseTaskDefinitionID(s string) (TaskDefinitionID, error) {
+	if strings.HasPrefix(s, "arn:") {
+		arn, err := ParseARN(s)
+		if err != nil {
+			return TaskDefinitionID{}, err
+		}
+		if arn.ResourceType != "task-definition" {
+			return TaskDefinitionID{}, fmt.Errorf("%q is not a task definition ARN", s)
+		}
+		s = arn.ShortName()
+	}
+
+	id := TaskDefinitionID{Family: s}
+	if i := strings.LastIndex(s, ":"); i != -1 {
+		rev, err := strconv.Atoi(s[i+1:])
+		if err != nil || rev < 1 {
+			return TaskDefinitionID{}, fmt.Errorf("invalid task definition %q, bad revision", s)
+		}
+		id = TaskDefinitionID{Family: s[:i], Revision: rev}
+	}
+	if id.Family == "" || strings.ContainsAny(id.Family, ":/") {
+		return TaskDefinitionID{}, fmt.Errorf("invalid task definition %q, bad family", s)
+	}
+	return id, nil
+}
+
+// String returns the short name, "family:revision", or just the family if
+// there's no revision.
+func (id TaskDefinitionID) String() string {
+	if id.Revision == 0 {
+		return id.Family
+	}
+	return fmt.Sprintf("%s:%d", id.Family, id.Revision)
+}
+
+// ARN returns the full ARN of the task definition in the given partition,
+// region and account.
+func (id TaskDefinitionID) ARN(partition, region, accountID string) ARN {
+	a := ARN{
+		Partition:    partition,
+		Service:      "ecs",
+		Region:       region,
+		AccountID:    accountID,
+		ResourceType: "task-definition",
+		ResourcePath: []string{id.Family},
+	}
+	if id.Revision != 0 {
+		a.Revision = strconv.Itoa(id.Revision)
+	}
+	return a
+}
+
+// IsZero returns true for an empty ID.
+func (id TaskDefinitionID) IsZero() bool {
+	return id == TaskDefinitionID{}
+}
+
+// Compare orders IDs by family and then revision, returning -1, 0 or 1.
+func (id TaskDefinitionID) Compare(other TaskDefinitionID) int {
+	switch {
+	case id.Family < other.Family:
+		return -1
+	case id.Family > other.Family:
+		return 1
+	case id.Revision < other.Revision:
+		return -1
+	case id.Revision > other.Revision:
+		return 1
+	}
+	return 0
+}
+
+// MarshalText implements encoding.TextMarshaler, so IDs are encoded as their
+// short name.
+func (id TaskDefinitionID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (id *TaskDefinitionID) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*id = TaskDefinitionID{}
+		return nil
+	}
+	parsed, err := ParseTaskDefinitionID(string(b))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// CloneTaskDefinition returns input that registers a new revision identical to
+// def, with the given tags. Fields assigned by ECS, such as the revision and
+// status, are left out, as are tags with the reserved "aws:" prefix, which
+// can't be set on registration. The input is a deep copy, so can be modified without
+// affecting def.
+func CloneTaskDefinition(def *ecs.TaskDefinition, tags []*ecs.Tag) *ecs.RegisterTaskDefinitionInput {
+	def = awsutil.CopyOf(def).(*ecs.TaskDefinition)
+	in := &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    def.ContainerDefinitions,
+		Cpu:                     def.Cpu,
+		EphemeralStorage:        def.EphemeralStorage,
+		ExecutionRoleArn:        def.ExecutionRoleArn,
+		Family:                  def.Family,
+		InferenceAccelerators:   def.InferenceAccelerators,
+		IpcMode:                 def.IpcMode,
+		Memory:                  def.Memory,
+		NetworkMode:             def.NetworkMode,
+		PidMode:                 def.PidMode,
+		PlacementConstraints:    def.PlacementConstraints,
+		ProxyConfiguration:      def.ProxyConfiguration,
+		RequiresCompatibilities: def.RequiresCompatibilities,
+		RuntimePlatform:         def.RuntimePlatform,
+		TaskRoleArn:             def.TaskRoleArn,
+		Volumes:                 def.Volumes,
+	}
+	for _, tag := range tags {
+		if strings.HasPrefix(strings.ToLower(aws.StringValue(tag.Key)), "aws:") {
+			continue
+		}
+		in.Tags = append(in.Tags, awsutil.CopyOf(tag).(*ecs.Tag))
+	}
+	return in
+}
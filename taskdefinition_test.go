@@ -0,0 +1,204 @@
+package esu
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestParseTaskDefinitionID(t *testing.T) {
+	cases := map[string]TaskDefinitionID{
+		"prod-website:38": {"prod-website", 38},
+		"prod-website":    {"prod-website", 0},
+		"arn:aws:ecs:us-east-1:12345678:task-definition/prod-website:38": {"prod-website", 38},
+	}
+	for s, e := range cases {
+		id, err := ParseTaskDefinitionID(s)
+		if err != nil {
+			t.Errorf("Parse error for %s: %s", s, err)
+		} else if id != e {
+			t.Errorf("Parse error for %s, wanted %#v was %#v", s, e, id)
+		}
+	}
+
+	invalid := []string{
+		"",
+		":38",
+		"website:",
+		"website:0",
+		"website:abc",
+		"arn:aws:ecs:us-east-1:12345678:service/sites/website",
+	}
+	for _, s := range invalid {
+		if id, err := ParseTaskDefinitionID(s); err == nil {
+			t.Errorf("expected error parsing %q, got %#v", s, id)
+		}
+	}
+}
+
+func TestTaskDefinitionIDFormatting(t *testing.T) {
+	id := TaskDefinitionID{"prod-website", 38}
+	if id.String() != "prod-website:38" {
+		t.Errorf("String() was %s", id)
+	}
+	arn := "arn:aws:ecs:us-east-1:12345678:task-definition/prod-website:38"
+	if s := id.ARN("aws", "us-east-1", "12345678").String(); s != arn {
+		t.Errorf("ARN() was %s", s)
+	}
+
+	b, _ := json.Marshal(TaskInfo{TaskDefinition: id})
+	var ti TaskInfo
+	if err := json.Unmarshal(b, &ti); err != nil || ti.TaskDefinition != id {
+		t.Errorf("JSON round trip failed, %s: %#v %v", b, ti.TaskDefinition, err)
+	}
+}
+
+func TestTaskDefinitionIDCompare(t *testing.T) {
+	ordered := []TaskDefinitionID{{"a", 0}, {"a", 2}, {"a", 10}, {"b", 1}}
+	for i := range ordered {
+		for j := range ordered {
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			if c := ordered[i].Compare(ordered[j]); c != expected {
+				t.Errorf("%s.Compare(%s) was %d, wanted %d", ordered[i], ordered[j], c, expected)
+			}
+		}
+	}
+}
+
+func TestCloneTaskDefinition(t *testing.T) {
+	def := &ecs.TaskDefinition{
+		TaskDefinitionArn: aws.String(taskDefARN("website", 38)),
+		Family:            aws.String("website"),
+		Revision:          aws.Int64(38),
+		Status:            aws.String(ecs.TaskDefinitionStatusActive),
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{Name: aws.String("website"), Image: aws.String("website:v1"), Environment: []*ecs.KeyValuePair{
+				{Name: aws.String("ENV"), Value: aws.String("prod")},
+			}},
+			{Name: aws.String("logger"), Image: aws.String("fluentd:v1")},
+		},
+		Cpu:                     aws.String("256"),
+		EphemeralStorage:        &ecs.EphemeralStorage{SizeInGiB: aws.Int64(30)},
+		ExecutionRoleArn:        aws.String("arn:aws:iam::12345678:role/execution"),
+		InferenceAccelerators:   []*ecs.InferenceAccelerator{{DeviceName: aws.String("eia"), DeviceType: aws.String("eia2.medium")}},
+		IpcMode:                 aws.String(ecs.IpcModeTask),
+		Memory:                  aws.String("512"),
+		NetworkMode:             aws.String(ecs.NetworkModeAwsvpc),
+		PidMode:                 aws.String(ecs.PidModeTask),
+		PlacementConstraints:    []*ecs.TaskDefinitionPlacementConstraint{{Type: aws.String("memberOf"), Expression: aws.String("attribute:ecs.os-type == linux")}},
+		ProxyConfiguration:      &ecs.ProxyConfiguration{ContainerName: aws.String("envoy")},
+		RequiresCompatibilities: []*string{aws.String(ecs.CompatibilityFargate)},
+		RuntimePlatform:         &ecs.RuntimePlatform{CpuArchitecture: aws.String(ecs.CPUArchitectureArm64)},
+		TaskRoleArn:             aws.String("arn:aws:iam::12345678:role/website"),
+		Volumes:                 []*ecs.Volume{{Name: aws.String("data"), Host: &ecs.HostVolumeProperties{SourcePath: aws.String("/data")}}},
+	}
+	tags := []*ecs.Tag{{Key: aws.String("team"), Value: aws.String("web")}}
+
+	in := CloneTaskDefinition(def, tags)
+
+	// Every registrable field must be copied from the template, so new fields
+	// in the SDK cause this test to fail until they're handled.
+	iv := reflect.ValueOf(in).Elem()
+	dv := reflect.ValueOf(def).Elem()
+	for i := 0; i < iv.NumField(); i++ {
+		field := iv.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		var expected interface{} = tags
+		if f := dv.FieldByName(field.Name); f.IsValid() {
+			expected = f.Interface()
+		}
+		if iv.Field(i).IsZero() {
+			t.Errorf("%s was not copied", field.Name)
+		} else if !reflect.DeepEqual(iv.Field(i).Interface(), expected) {
+			t.Errorf("%s was %v, wanted %v", field.Name, iv.Field(i).Interface(), expected)
+		}
+	}
+	if err := in.Validate(); err != nil {
+		t.Errorf("invalid input: %s", err)
+	}
+
+	// The copy is deep.
+	in.ContainerDefinitions[0].Image = aws.String("website:v2")
+	in.ContainerDefinitions[0].Environment[0].Value = aws.String("staging")
+	in.Tags[0].Value = aws.String("ops")
+	if *def.ContainerDefinitions[0].Image != "website:v1" || *def.ContainerDefinitions[0].Environment[0].Value != "prod" || *tags[0].Value != "web" {
+		t.Error("modifying the clone changed the template")
+	}
+
+	// Tags reserved by AWS can't be registered.
+	in = CloneTaskDefinition(def, []*ecs.Tag{
+		{Key: aws.String("aws:cloudformation:stack-name"), Value: aws.String("web")},
+		{Key: aws.String("AWS:ecs:managed"), Value: aws.String("true")},
+		{Key: aws.String("team"), Value: aws.String("web")},
+	})
+	if len(in.Tags) != 1 || *in.Tags[0].Key != "team" {
+		t.Errorf("expected aws: tags to be dropped, got %v", in.Tags)
+	}
+}
+
+func TestDiffTaskDefinitions(t *testing.T) {
+	from := &ecs.RegisterTaskDefinitionInput{
+		Family: aws.String("website"),
+		Cpu:    aws.String("256"),
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{
+				Name:         aws.String("website"),
+				Image:        aws.String("website:v1"),
+				Memory:       aws.Int64(512),
+				PortMappings: []*ecs.PortMapping{{ContainerPort: aws.Int64(8080), HostPort: aws.Int64(0), Protocol: aws.String("tcp")}},
+				Environment: []*ecs.KeyValuePair{
+					{Name: aws.String("ENV"), Value: aws.String("prod")},
+					{Name: aws.String("OLD"), Value: aws.String("1")},
+				},
+			},
+			{Name: aws.String("logger"), Image: aws.String("fluentd:v1")},
+		},
+	}
+	to := CloneTaskDefinition(&ecs.TaskDefinition{
+		Family:               from.Family,
+		Cpu:                  aws.String("512"),
+		ContainerDefinitions: from.ContainerDefinitions,
+	}, nil)
+	c := to.ContainerDefinitions[0]
+	c.Image = aws.String("website:v2")
+	c.Memory = aws.Int64(1024)
+	c.PortMappings[0].ContainerPort = aws.Int64(9090)
+	c.Environment = []*ecs.KeyValuePair{
+		{Name: aws.String("ENV"), Value: aws.String("prod")},
+		{Name: aws.String("NEW"), Value: aws.String("2")},
+	}
+	to.ContainerDefinitions[1] = &ecs.ContainerDefinition{Name: aws.String("worker"), Image: aws.String("worker:v1")}
+
+	expected := []string{
+		"cpu: 256 -> 512",
+		"logger container: fluentd:v1 -> (none)",
+		"website image: website:v1 -> website:v2",
+		"website memory: 512 -> 1024",
+		"website ports: 8080->0/tcp -> 9090->0/tcp",
+		"website env NEW: (none) -> 2",
+		"website env OLD: 1 -> (none)",
+		"worker container: (none) -> worker:v1",
+	}
+	changes := DiffTaskDefinitions(from, to)
+	if len(changes) != len(expected) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	for i, c := range changes {
+		if c.String() != expected[i] {
+			t.Errorf("change %d was %q, wanted %q", i, c, expected[i])
+		}
+	}
+	if len(DiffTaskDefinitions(from, from)) != 0 {
+		t.Error("expected no changes comparing a task definition to itself")
+	}
+}
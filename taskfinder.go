@@ -13,6 +13,10 @@ import (
 
 // TaskFinder provides a wrapper around the AWS-SDK for locating ECS tasks.
 type TaskFinder struct {
+	// OnInvalidTask is called when a task is left out of a listing because its
+	// task definition ARN can't be parsed.
+	OnInvalidTask func(error)
+
 	cluster string
 	ecs     *ecs.ECS
 	ec2     *ec2.EC2
@@ -54,6 +58,16 @@ func (f *TaskFinder) Services() ([]string, error) {
 // Tasks returns information about a service's running tasks, sorted first by
 // public DNS name and then port.
 func (f *TaskFinder) Tasks(service string) ([]TaskInfo, error) {
+	return f.TasksForPort(service, 0)
+}
+
+// TasksForPort is like Tasks, but TaskInfo.Port is the host port mapped to the
+// given container port, in any of the task's containers. This is useful when a
+// task exposes something other than its canonical port, such as metrics.
+// Tasks without a mapping for the port have a Port of zero. A containerPort of
+// zero behaves the same as Tasks. Tasks with an invalid task definition ARN are
+// skipped and reported to OnInvalidTask.
+func (f *TaskFinder) TasksForPort(service string, containerPort int) ([]TaskInfo, error) {
 	tasksArns, err := f.fetchTasks(service)
 	if err != nil {
 		return nil, err
@@ -71,14 +85,26 @@ func (f *TaskFinder) Tasks(service string) ([]TaskInfo, error) {
 	}
 	infos := []TaskInfo{}
 	for _, t := range tasks {
-		port, err := f.getPortForTask(t, service)
-		if err != nil {
+		var port int
+		if containerPort != 0 {
+			port = getHostPort(t, containerPort)
+		} else if port, err = f.getPortForTask(t, service); err != nil {
 			return nil, fmt.Errorf("%s, cluster=%s, service=%s, task=%s", err, f.cluster, service, *t.TaskArn)
 		}
+		taskDef, err := ParseTaskDefinitionID(realString(t.TaskDefinitionArn))
+		if err != nil {
+			// Skip the task rather than failing the whole listing.
+			if f.OnInvalidTask != nil {
+				f.OnInvalidTask(fmt.Errorf("%s, cluster=%s, service=%s, task=%s", err, f.cluster, service, *t.TaskArn))
+			}
+			continue
+		}
 		info := TaskInfo{
-			TaskDefinition: ParseARN(*t.TaskDefinitionArn).ShortName(),
+			TaskARN:        realString(t.TaskArn),
+			TaskDefinition: taskDef,
 			DesiredStatus:  ECSTaskStatus(realString(t.DesiredStatus)),
 			LastStatus:     ECSTaskStatus(realString(t.LastStatus)),
+			HealthStatus:   ECSHealthStatus(realString(t.HealthStatus)),
 			StartedAt:      realTime(t.StartedAt),
 			Port:           port,
 		}
@@ -90,6 +116,9 @@ func (f *TaskFinder) Tasks(service string) ([]TaskInfo, error) {
 				info.PrivateDNSName = realString(in.PrivateDnsName)
 				info.PublicIPAddress = realString(in.PublicIpAddress)
 				info.PrivateIPAddress = realString(in.PrivateIpAddress)
+				if in.Placement != nil {
+					info.AvailabilityZone = realString(in.Placement.AvailabilityZone)
+				}
 			}
 		}
 		infos = append(infos, info)
@@ -128,6 +157,19 @@ func (f *TaskFinder) getPortForTask(t *ecs.Task, service string) (int, error) {
 	return int(*c.NetworkBindings[0].HostPort), nil
 }
 
+// getHostPort returns the host port mapped to a container port, or zero if the
+// port isn't mapped.
+func getHostPort(t *ecs.Task, containerPort int) int {
+	for _, c := range t.Containers {
+		for _, b := range c.NetworkBindings {
+			if b.ContainerPort != nil && b.HostPort != nil && int(*b.ContainerPort) == containerPort {
+				return int(*b.HostPort)
+			}
+		}
+	}
+	return 0
+}
+
 func (f *TaskFinder) locateTasks(tasks []*ecs.Task) (map[string]*ec2.Instance, error) {
 	if len(tasks) == 0 {
 		return map[string]*ec2.Instance{}, nil
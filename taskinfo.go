@@ -2,6 +2,8 @@ package esu
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"time"
 )
 
@@ -18,12 +20,30 @@ const (
 	ECSTaskStatusStopped ECSTaskStatus = "STOPPED"
 )
 
+// ECSHealthStatus is the health of a task, as reported by container health
+// checks.
+type ECSHealthStatus string
+
+const (
+	// ECSHealthStatusHealthy indicates all essential containers are passing
+	// their health checks.
+	ECSHealthStatusHealthy ECSHealthStatus = "HEALTHY"
+	// ECSHealthStatusUnhealthy indicates an essential container is failing its
+	// health check.
+	ECSHealthStatusUnhealthy ECSHealthStatus = "UNHEALTHY"
+	// ECSHealthStatusUnknown indicates health checks haven't run yet, or none
+	// are defined.
+	ECSHealthStatusUnknown ECSHealthStatus = "UNKNOWN"
+)
+
 // TaskInfo specifies information about a task running on ECS. A service may
 // have multiple tasks associated with it.
 type TaskInfo struct {
-	TaskDefinition   string
+	TaskARN          string
+	TaskDefinition   TaskDefinitionID
 	DesiredStatus    ECSTaskStatus
 	LastStatus       ECSTaskStatus
+	HealthStatus     ECSHealthStatus
 	StartedAt        time.Time
 	Port             int
 	EC2InstanceID    string
@@ -31,6 +51,7 @@ type TaskInfo struct {
 	PublicIPAddress  string
 	PrivateDNSName   string
 	PrivateIPAddress string
+	AvailabilityZone string
 }
 
 func (ti TaskInfo) String() string {
@@ -40,6 +61,20 @@ func (ti TaskInfo) String() string {
 	return fmt.Sprintf("[%s] %s @ %s:%d", ti.LastStatus, ti.TaskDefinition, ti.PublicIPAddress, ti.Port)
 }
 
+// TaskID returns the ID portion of the task's ARN.
+func (ti TaskInfo) TaskID() string {
+	arn, err := ParseARN(ti.TaskARN)
+	if err != nil {
+		return ""
+	}
+	return arn.Name()
+}
+
+// PrivateAddress returns the "host:port" address of the task within the VPC.
+func (ti TaskInfo) PrivateAddress() string {
+	return net.JoinHostPort(ti.PrivateIPAddress, strconv.Itoa(ti.Port))
+}
+
 type taskInfoList []TaskInfo
 
 func (a taskInfoList) Len() int      { return len(a) }
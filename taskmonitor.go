@@ -1,6 +1,9 @@
 package esu
 
 import (
+	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -18,44 +21,198 @@ const DefaultVolatilePollFreq = time.Second * 1
 // seen before the monitor is considered stable, following an error.
 const numUpdatesForStable = 5
 
-// TaskMonitor is
+// TaskLister is the subset of TaskFinder used by TaskMonitor. Other
+// implementations can be supplied, for example to return canned results in
+// tests.
+type TaskLister interface {
+	Tasks(service string) ([]TaskInfo, error)
+}
+
+// TaskMonitor polls ECS for the tasks belonging to a service and notifies
+// callbacks when they change.
 type TaskMonitor struct {
 	Service          string
 	PollFreq         time.Duration
 	VolatilePollFreq time.Duration
-	OnStatusChange   func([]TaskInfo)
-	OnTaskChange     func([]TaskInfo)
-	OnError          func(error)
-	taskFinder       *TaskFinder
-	allTasks         []TaskInfo
-	runningTasks     []TaskInfo
-	updatesSinceErr  int
+
+	// StaleAfter is how long the monitor can go without a successful update
+	// before its data is considered stale. Zero disables staleness checks.
+	StaleAfter time.Duration
+
+	// FailClosed causes RunningTasks to return no tasks while the data is
+	// stale, and OnTaskChange and task listeners to be called with no tasks
+	// when it becomes stale, then with the tasks again once it recovers. By
+	// default the last known good tasks continue to be served.
+	FailClosed bool
+
+	// SnapshotPath, if set, is a file the monitor saves its latest tasks to
+	// after each change. Monitor loads it on startup so tasks are available
+	// before the first update completes, or if ECS is unreachable.
+	SnapshotPath string
+
+	OnStatusChange func([]TaskInfo)
+	OnTaskChange   func([]TaskInfo)
+	OnError        func(error)
+
+	// OnStale is called once when the monitor becomes stale, with the time
+	// since the last successful update. It is called again only after a
+	// successful update has cleared the stale state.
+	OnStale func(time.Duration)
+
+	taskFinder TaskLister
+	now        func() time.Time
+
+	mu              sync.RWMutex
+	allTasks        []TaskInfo
+	runningTasks    []TaskInfo
+	updatesSinceErr int
+	created         time.Time
+	lastSuccess     time.Time
+	staleNotified   bool
+	provisional     bool
+	listeners       []func([]TaskInfo)
 }
 
 // NewTaskMonitor returns a new task monitor.
 func NewTaskMonitor(sess *session.Session, cluster string, service string) *TaskMonitor {
+	return NewTaskMonitorWithLister(NewTaskFinder(sess, cluster), service)
+}
+
+// NewTaskMonitorWithLister returns a new task monitor that gets its tasks from
+// the provided lister.
+func NewTaskMonitorWithLister(finder TaskLister, service string) *TaskMonitor {
 	return &TaskMonitor{
 		Service:          service,
 		PollFreq:         DefaultPollFreq,
 		VolatilePollFreq: DefaultVolatilePollFreq,
-		taskFinder:       NewTaskFinder(sess, cluster),
+		taskFinder:       finder,
+		now:              time.Now,
+		created:          time.Now(),
 	}
 }
 
-// RunningTasks returns a list of currently running tasks.
+// RunningTasks returns a list of currently running tasks. If the monitor is
+// stale and FailClosed is set, no tasks are returned.
 func (tm *TaskMonitor) RunningTasks() []TaskInfo {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	if tm.FailClosed && tm.isStale() {
+		return []TaskInfo{}
+	}
 	return tm.runningTasks
 }
 
 // AllTasks returns a list of all tasks, including pending and stopped.
 func (tm *TaskMonitor) AllTasks() []TaskInfo {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
 	return tm.allTasks
 }
 
+// LastSuccessfulUpdate returns the time ECS was last queried successfully, or
+// the zero time if no update has succeeded yet.
+func (tm *TaskMonitor) LastSuccessfulUpdate() time.Time {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.lastSuccess
+}
+
+// Staleness returns how long it has been since the last successful update. If
+// no update has succeeded, it is the time since the monitor was created.
+func (tm *TaskMonitor) Staleness() time.Duration {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.staleness()
+}
+
+// IsStale returns true if StaleAfter is set and the monitor has gone longer
+// than that without a successful update.
+func (tm *TaskMonitor) IsStale() bool {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.isStale()
+}
+
+func (tm *TaskMonitor) staleness() time.Duration {
+	if tm.lastSuccess.IsZero() {
+		return tm.now().Sub(tm.created)
+	}
+	return tm.now().Sub(tm.lastSuccess)
+}
+
+func (tm *TaskMonitor) isStale() bool {
+	return tm.StaleAfter > 0 && tm.staleness() > tm.StaleAfter
+}
+
+// IsProvisional returns true if the monitor's tasks were loaded from a snapshot
+// and have not yet been confirmed by a successful update.
+func (tm *TaskMonitor) IsProvisional() bool {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.provisional
+}
+
+// AddTaskListener registers fn to be called with the running tasks whenever
+// they change, after OnTaskChange. Unlike setting OnTaskChange, it is safe to
+// call while the monitor is running.
+func (tm *TaskMonitor) AddTaskListener(fn func([]TaskInfo)) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.listeners = append(tm.listeners, fn)
+}
+
+// notifyTaskChange calls OnTaskChange and the registered listeners.
+func (tm *TaskMonitor) notifyTaskChange(running []TaskInfo) {
+	tm.mu.RLock()
+	listeners := tm.listeners
+	tm.mu.RUnlock()
+	if tm.OnTaskChange != nil {
+		tm.OnTaskChange(running)
+	}
+	for _, fn := range listeners {
+		fn(running)
+	}
+}
+
+// LoadSnapshot populates the monitor from SnapshotPath. The tasks are marked
+// provisional until the first successful update. It is a no-op if the monitor
+// already has live data.
+func (tm *TaskMonitor) LoadSnapshot() error {
+	s, err := readSnapshot(tm.SnapshotPath)
+	if err != nil {
+		return err
+	}
+	if s.Service != tm.Service {
+		return fmt.Errorf("snapshot %s is for service %q, not %q", tm.SnapshotPath, s.Service, tm.Service)
+	}
+
+	tm.mu.Lock()
+	if !tm.lastSuccess.IsZero() {
+		tm.mu.Unlock()
+		return nil
+	}
+	tm.allTasks = s.Tasks
+	tm.runningTasks = runningTasks(s.Tasks)
+	tm.provisional = true
+	running := tm.runningTasks
+	tm.mu.Unlock()
+
+	if tm.OnStatusChange != nil {
+		tm.OnStatusChange(s.Tasks)
+	}
+	tm.notifyTaskChange(running)
+	return nil
+}
+
 // Monitor polls for changes in running tasks, relevant callbacks are executed
 // when changes are detected. There should only be one active Monitor per
 // instance.
 func (tm *TaskMonitor) Monitor() chan<- bool {
+	if tm.SnapshotPath != "" {
+		if err := tm.LoadSnapshot(); err != nil && !os.IsNotExist(err) && tm.OnError != nil {
+			tm.OnError(err)
+		}
+	}
 	tm.Update()
 	cancel := make(chan bool, 1)
 	go func() {
@@ -78,6 +235,8 @@ func (tm *TaskMonitor) Monitor() chan<- bool {
 // IsVolatile returns true if any tasks have a desired status that doesn't match
 // last status, or an error was encountered recently.
 func (tm *TaskMonitor) IsVolatile() bool {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
 	if tm.updatesSinceErr < numUpdatesForStable {
 		// Haven't had enough successful updates to be considered stable.
 		return false
@@ -95,26 +254,64 @@ func (tm *TaskMonitor) IsVolatile() bool {
 func (tm *TaskMonitor) Update() bool {
 	tasks, err := tm.taskFinder.Tasks(tm.Service)
 	if err != nil {
+		tm.mu.Lock()
 		tm.updatesSinceErr = 0
+		notifyStale := tm.isStale() && !tm.staleNotified
+		if notifyStale {
+			tm.staleNotified = true
+		}
+		staleness := tm.staleness()
+		tm.mu.Unlock()
+
 		if tm.OnError != nil {
 			tm.OnError(err)
 		}
+		if notifyStale && tm.OnStale != nil {
+			tm.OnStale(staleness)
+		}
+		if notifyStale && tm.FailClosed {
+			// Stop consumers from using tasks that may no longer exist.
+			tm.notifyTaskChange([]TaskInfo{})
+			return true
+		}
 		return false
 	}
+
+	tm.mu.Lock()
 	tm.updatesSinceErr++
-	if !taskInfosEqual(tasks, tm.allTasks) {
+	tm.lastSuccess = tm.now()
+	// Consumers were told there were no tasks while failing closed.
+	recovered := tm.staleNotified && tm.FailClosed
+	tm.staleNotified = false
+	tm.provisional = false
+	statusChanged := !taskInfosEqual(tasks, tm.allTasks)
+	taskChanged := false
+	var running []TaskInfo
+	if statusChanged {
 		tm.allTasks = tasks
-		if tm.OnStatusChange != nil {
-			tm.OnStatusChange(tasks)
-		}
-		running := runningTasks(tasks)
+		running = runningTasks(tasks)
 		if !taskInfosEqual(running, tm.runningTasks) {
 			tm.runningTasks = running
-			if tm.OnTaskChange != nil {
-				tm.OnTaskChange(running)
-			}
-			return true
+			taskChanged = true
 		}
 	}
-	return false
+	if recovered && !taskChanged {
+		running = tm.runningTasks
+		taskChanged = true
+	}
+	tm.mu.Unlock()
+
+	if statusChanged && tm.SnapshotPath != "" {
+		s := &snapshot{Service: tm.Service, SavedAt: tm.now(), Tasks: tasks}
+		if err := writeSnapshot(tm.SnapshotPath, s); err != nil && tm.OnError != nil {
+			tm.OnError(propagate(err, "saving snapshot"))
+		}
+	}
+	if statusChanged && tm.OnStatusChange != nil {
+		tm.OnStatusChange(tasks)
+	}
+	if taskChanged {
+		tm.notifyTaskChange(running)
+	}
+	return taskChanged
 }
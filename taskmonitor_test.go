@@ -0,0 +1,177 @@
+package esu
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeFinder struct {
+	tasks []TaskInfo
+	err   error
+}
+
+func (f *fakeFinder) Tasks(service string) ([]TaskInfo, error) {
+	return f.tasks, f.err
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time          { return c.t }
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func runningTask(ip string, port int) TaskInfo {
+	return TaskInfo{
+		TaskDefinition:   TaskDefinitionID{Family: "website", Revision: 1},
+		DesiredStatus:    ECSTaskStatusRunning,
+		LastStatus:       ECSTaskStatusRunning,
+		Port:             port,
+		EC2InstanceID:    "i-" + ip,
+		PrivateIPAddress: ip,
+	}
+}
+
+func TestTaskMonitorFailClosedNotifies(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	finder := &fakeFinder{tasks: []TaskInfo{runningTask("10.0.0.1", 8080)}}
+	tm := NewTaskMonitorWithLister(finder, "website")
+	tm.now = clock.Now
+	tm.StaleAfter = time.Minute
+	tm.FailClosed = true
+	var seen []int
+	tm.AddTaskListener(func(tasks []TaskInfo) { seen = append(seen, len(tasks)) })
+
+	tm.Update()
+	finder.err = errors.New("ecs unavailable")
+	clock.Advance(2 * time.Minute)
+	tm.Update()
+	tm.Update()
+	finder.err = nil
+	tm.Update()
+	if fmt.Sprint(seen) != "[1 0 1]" {
+		t.Errorf("expected listener to see tasks, no tasks while stale, then tasks again, saw %v", seen)
+	}
+}
+
+func TestTaskMonitorStaleness(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	finder := &fakeFinder{tasks: []TaskInfo{runningTask("10.0.0.1", 8080)}}
+	tm := NewTaskMonitorWithLister(finder, "website")
+	tm.now = clock.Now
+	tm.created = clock.Now()
+	tm.StaleAfter = time.Minute
+
+	var staleCalls []time.Duration
+	tm.OnStale = func(d time.Duration) { staleCalls = append(staleCalls, d) }
+
+	if !tm.Update() {
+		t.Fatal("expected first update to report a change")
+	}
+	if tm.LastSuccessfulUpdate() != clock.Now() {
+		t.Errorf("LastSuccessfulUpdate was %s, wanted %s", tm.LastSuccessfulUpdate(), clock.Now())
+	}
+
+	finder.err = errors.New("ecs unavailable")
+	clock.Advance(30 * time.Second)
+	tm.Update()
+	if tm.IsStale() {
+		t.Error("monitor should not be stale after 30s")
+	}
+	if len(staleCalls) != 0 {
+		t.Errorf("OnStale called too early: %v", staleCalls)
+	}
+
+	clock.Advance(45 * time.Second)
+	tm.Update()
+	tm.Update()
+	if !tm.IsStale() {
+		t.Error("monitor should be stale after 75s")
+	}
+	if got := tm.Staleness(); got != 75*time.Second {
+		t.Errorf("Staleness was %s, wanted 75s", got)
+	}
+	if len(staleCalls) != 1 || staleCalls[0] != 75*time.Second {
+		t.Errorf("OnStale should be called once with 75s, was %v", staleCalls)
+	}
+
+	// Last known good is served by default.
+	if n := len(tm.RunningTasks()); n != 1 {
+		t.Errorf("expected last known good task to be served, got %d tasks", n)
+	}
+	tm.FailClosed = true
+	if n := len(tm.RunningTasks()); n != 0 {
+		t.Errorf("expected no tasks when failing closed, got %d", n)
+	}
+
+	// A successful update clears the stale state and re-arms OnStale.
+	finder.err = nil
+	tm.Update()
+	if tm.IsStale() {
+		t.Error("monitor should not be stale after a successful update")
+	}
+	if n := len(tm.RunningTasks()); n != 1 {
+		t.Errorf("expected tasks after recovery, got %d", n)
+	}
+	finder.err = errors.New("ecs unavailable")
+	clock.Advance(2 * time.Minute)
+	tm.Update()
+	if len(staleCalls) != 2 {
+		t.Errorf("OnStale should fire again after recovery, was called %d times", len(staleCalls))
+	}
+}
+
+func TestTaskMonitorSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "website.json")
+
+	finder := &fakeFinder{tasks: []TaskInfo{runningTask("10.0.0.1", 8080), runningTask("10.0.0.2", 8080)}}
+	tm := NewTaskMonitorWithLister(finder, "website")
+	tm.SnapshotPath = path
+	tm.Update()
+
+	// A fresh monitor, with ECS unavailable, should warm start from the snapshot.
+	finder = &fakeFinder{err: errors.New("ecs unavailable")}
+	tm = NewTaskMonitorWithLister(finder, "website")
+	tm.SnapshotPath = path
+	var changed []TaskInfo
+	tm.OnTaskChange = func(tasks []TaskInfo) { changed = tasks }
+	if err := tm.LoadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	tm.Update()
+	if n := len(tm.RunningTasks()); n != 2 {
+		t.Errorf("expected 2 tasks from snapshot, got %d", n)
+	}
+	if len(changed) != 2 {
+		t.Errorf("expected OnTaskChange with 2 tasks from snapshot, got %d", len(changed))
+	}
+	if !tm.IsProvisional() {
+		t.Error("tasks loaded from a snapshot should be provisional")
+	}
+
+	finder.err = nil
+	finder.tasks = []TaskInfo{runningTask("10.0.0.3", 8080)}
+	tm.Update()
+	if tm.IsProvisional() {
+		t.Error("tasks should not be provisional after a successful update")
+	}
+	if len(changed) != 1 || changed[0].PrivateIPAddress != "10.0.0.3" {
+		t.Errorf("expected live task to replace snapshot, got %v", changed)
+	}
+
+	tm = NewTaskMonitorWithLister(finder, "other")
+	tm.SnapshotPath = path
+	if err := tm.LoadSnapshot(); err == nil {
+		t.Error("expected error loading snapshot for a different service")
+	}
+}
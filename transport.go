@@ -0,0 +1,210 @@
+package esu
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// ServiceHostSuffix is the pseudo top level domain that Transport intercepts,
+// requests to "http://website.ecs/" are routed to the "website" service.
+const ServiceHostSuffix = ".ecs"
+
+// DefaultTransportRetries is how many other tasks an idempotent request will be
+// retried on after a connection failure.
+const DefaultTransportRetries = 2
+
+// Transport is an http.RoundTripper that routes requests for hosts ending in
+// ServiceHostSuffix to a running task of the named ECS service. All other
+// requests are passed through to the base transport.
+type Transport struct {
+	// Base is the transport used to make requests, http.DefaultTransport is
+	// used if nil.
+	Base http.RoundTripper
+
+	// Retries is how many other tasks an idempotent request is retried on when
+	// a connection can't be established.
+	Retries int
+
+	// Policy is used for balancers the transport creates itself.
+	Policy BalancerPolicy
+
+	newMonitor func(service string) *TaskMonitor
+
+	mu       sync.Mutex
+	services map[string]*transportService
+	cancels  []chan<- bool
+}
+
+// transportService holds a service's balancer. The monitor behind it is
+// started once, outside the transport's lock, so a slow first update doesn't
+// hold up requests to other services.
+type transportService struct {
+	once sync.Once
+	b    *Balancer
+}
+
+// NewTransport returns a transport that monitors services on the cluster as
+// they are first requested.
+func NewTransport(sess *session.Session, cluster string) *Transport {
+	t := newTransport()
+	t.newMonitor = func(service string) *TaskMonitor {
+		return NewTaskMonitor(sess, cluster, service)
+	}
+	return t
+}
+
+func newTransport() *Transport {
+	return &Transport{
+		Retries:  DefaultTransportRetries,
+		Policy:   PowerOfTwoChoices,
+		services: map[string]*transportService{},
+	}
+}
+
+// AddService routes requests for a service using an existing balancer.
+func (t *Transport) AddService(service string, b *Balancer) {
+	s := &transportService{b: b}
+	s.once.Do(func() {})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.services[service] = s
+}
+
+// Close stops any monitors started by the transport.
+func (t *Transport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.cancels {
+		c <- true
+	}
+	t.cancels = nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if !strings.HasSuffix(host, ServiceHostSuffix) {
+		return t.base().RoundTrip(req)
+	}
+	service := strings.TrimSuffix(host, ServiceHostSuffix)
+	b, err := t.balancer(service)
+	if err != nil {
+		return nil, err
+	}
+
+	var tried []TaskInfo
+	for attempt := 0; ; attempt++ {
+		sel, err := b.PickExcluding(tried...)
+		if err != nil {
+			return nil, propagate(err, service)
+		}
+		outreq, err := rewriteRequest(req, sel.Task, attempt)
+		if err != nil {
+			sel.Done(nil)
+			return nil, err
+		}
+		resp, err := t.base().RoundTrip(outreq)
+		if err == nil {
+			resp.Body = &selectionBody{ReadCloser: resp.Body, sel: sel}
+			return resp, nil
+		}
+		if !isConnError(err) {
+			sel.Done(nil)
+			return nil, err
+		}
+		sel.Done(err)
+		tried = append(tried, sel.Task)
+		if attempt >= t.Retries || !isRetryable(req) {
+			return nil, err
+		}
+	}
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// balancer returns the balancer for a service, starting a monitor for it if
+// the transport was created with NewTransport.
+func (t *Transport) balancer(service string) (*Balancer, error) {
+	t.mu.Lock()
+	s, ok := t.services[service]
+	if !ok {
+		if t.newMonitor == nil {
+			t.mu.Unlock()
+			return nil, errors.New("unknown service: " + service)
+		}
+		s = &transportService{}
+		t.services[service] = s
+	}
+	t.mu.Unlock()
+
+	s.once.Do(func() {
+		tm := t.newMonitor(service)
+		s.b = NewBalancer(tm, t.Policy)
+		cancel := tm.Monitor()
+		t.mu.Lock()
+		t.cancels = append(t.cancels, cancel)
+		t.mu.Unlock()
+	})
+	return s.b, nil
+}
+
+// rewriteRequest returns a copy of the request addressed to the task. The Host
+// header is left as the original service name.
+func rewriteRequest(req *http.Request, task TaskInfo, attempt int) (*http.Request, error) {
+	out := req.Clone(req.Context())
+	out.URL.Host = task.PrivateAddress()
+	if out.Host == "" {
+		out.Host = req.URL.Host
+	}
+	if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+	return out, nil
+}
+
+// isConnError returns true if a connection to the task couldn't be
+// established. Errors after connecting aren't included, since the server may
+// have already acted on the request.
+func isConnError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isRetryable returns true for idempotent requests whose body can be replayed.
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// selectionBody releases a balancer selection when the response body is
+// closed, so in-flight counts cover the full request.
+type selectionBody struct {
+	io.ReadCloser
+	sel *Selection
+}
+
+func (b *selectionBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.sel.Done(nil)
+	return err
+}
@@ -0,0 +1,100 @@
+package esu
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func taskForServer(t *testing.T, addr string) TaskInfo {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return runningTask(host, p)
+}
+
+// deadAddr returns an address that refuses connections.
+func deadAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestTransportRoutesAndRetries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	b := newBalancer(RoundRobin)
+	b.Update([]TaskInfo{
+		taskForServer(t, deadAddr(t)),
+		taskForServer(t, strings.TrimPrefix(srv.URL, "http://")),
+	})
+	tr := newTransport()
+	tr.AddService("website", b)
+	client := &http.Client{Transport: tr}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://website.ecs/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "website.ecs/hello" {
+			t.Errorf("unexpected response %q", body)
+		}
+	}
+
+	// Non-idempotent requests aren't retried on another task.
+	b.Update([]TaskInfo{taskForServer(t, deadAddr(t))})
+	if _, err := client.Post("http://website.ecs/", "text/plain", strings.NewReader("hi")); err == nil {
+		t.Error("expected POST to a dead task to fail")
+	}
+
+	if _, err := client.Get("http://other.ecs/"); err == nil {
+		t.Error("expected error for unknown service")
+	}
+}
+
+func TestTransportPassesThrough(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: newTransport()}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "direct" {
+		t.Errorf("unexpected response %q", body)
+	}
+}
+
+func TestIsConnError(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	if !isConnError(fmt.Errorf("get: %w", dial)) {
+		t.Error("expected dial error to be a connection error")
+	}
+	if isConnError(read) {
+		t.Error("read errors happen after the request may have been sent")
+	}
+}
@@ -0,0 +1,162 @@
+// Package xds is an Envoy control plane that serves ECS service membership
+// over EDS. Each monitored service is exposed as a ClusterLoadAssignment named
+// after the service, with endpoints grouped into localities by availability
+// zone and health taken from ECS container health checks.
+//
+// Envoy clusters should use EDS with this server as their eds_config:
+//
+//	clusters:
+//	- name: website
+//	  type: EDS
+//	  eds_cluster_config:
+//	    eds_config:
+//	      api_config_source:
+//	        api_type: GRPC
+//	        grpc_services: [{envoy_grpc: {cluster_name: esu}}]
+package xds
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/dpup/esu"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"google.golang.org/grpc"
+)
+
+// nodeGroup is the snapshot key used for every Envoy node, since all nodes see
+// the same endpoints.
+const nodeGroup = "esu"
+
+// Server serves EDS for a set of monitored services.
+type Server struct {
+	OnError func(error)
+
+	cache cache.SnapshotCache
+
+	mu       sync.Mutex
+	monitors map[string]*esu.TaskMonitor
+	version  int
+}
+
+// New returns a server with no services.
+func New() *Server {
+	return &Server{
+		cache:    cache.NewSnapshotCache(false, allNodes{}, nil),
+		monitors: map[string]*esu.TaskMonitor{},
+	}
+}
+
+// AddService exposes the monitor's running tasks as the EDS cluster with the
+// given name. Updates are pushed to Envoy whenever the monitor's tasks change. The
+// caller is responsible for starting the monitor.
+func (s *Server) AddService(cluster string, tm *esu.TaskMonitor) {
+	s.mu.Lock()
+	s.monitors[cluster] = tm
+	s.mu.Unlock()
+	tm.AddTaskListener(func([]esu.TaskInfo) { s.push() })
+	s.push()
+}
+
+// Serve accepts xDS connections on the listener, serving both EDS and ADS.
+func (s *Server) Serve(l net.Listener) error {
+	g := grpc.NewServer()
+	srv := server.NewServer(context.Background(), s.cache, nil)
+	discovery.RegisterAggregatedDiscoveryServiceServer(g, srv)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(g, srv)
+	return g.Serve(l)
+}
+
+// push builds a new snapshot from every service's running tasks.
+func (s *Server) push() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	assignments := []types.Resource{}
+	for name, tm := range s.monitors {
+		assignments = append(assignments, ClusterLoadAssignment(name, tm.RunningTasks()))
+	}
+	snap, err := cache.NewSnapshot(fmt.Sprint(s.version), map[resource.Type][]types.Resource{
+		resource.EndpointType: assignments,
+	})
+	if err == nil {
+		err = s.cache.SetSnapshot(context.Background(), nodeGroup, snap)
+	}
+	if err != nil && s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+// ClusterLoadAssignment converts tasks to an EDS resource. Tasks are grouped
+// into localities by availability zone.
+func ClusterLoadAssignment(cluster string, tasks []esu.TaskInfo) *endpoint.ClusterLoadAssignment {
+	byZone := map[string][]*endpoint.LbEndpoint{}
+	for _, t := range tasks {
+		byZone[t.AvailabilityZone] = append(byZone[t.AvailabilityZone], lbEndpoint(t))
+	}
+	zones := make([]string, 0, len(byZone))
+	for z := range byZone {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+
+	cla := &endpoint.ClusterLoadAssignment{ClusterName: cluster}
+	for _, z := range zones {
+		cla.Endpoints = append(cla.Endpoints, &endpoint.LocalityLbEndpoints{
+			Locality:    &core.Locality{Zone: z},
+			LbEndpoints: byZone[z],
+		})
+	}
+	return cla
+}
+
+func lbEndpoint(t esu.TaskInfo) *endpoint.LbEndpoint {
+	return &endpoint.LbEndpoint{
+		HealthStatus: healthStatus(t.HealthStatus),
+		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+			Endpoint: &endpoint.Endpoint{
+				Address: &core.Address{
+					Address: &core.Address_SocketAddress{
+						SocketAddress: &core.SocketAddress{
+							Protocol: core.SocketAddress_TCP,
+							Address:  t.PrivateIPAddress,
+							PortSpecifier: &core.SocketAddress_PortValue{
+								PortValue: uint32(t.Port),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// healthStatus maps ECS health to Envoy's. Tasks without health checks are
+// UNKNOWN, which Envoy routes to.
+func healthStatus(h esu.ECSHealthStatus) core.HealthStatus {
+	switch h {
+	case esu.ECSHealthStatusHealthy:
+		return core.HealthStatus_HEALTHY
+	case esu.ECSHealthStatusUnhealthy:
+		return core.HealthStatus_UNHEALTHY
+	default:
+		return core.HealthStatus_UNKNOWN
+	}
+}
+
+// allNodes hashes every Envoy node to the same snapshot.
+type allNodes struct{}
+
+func (allNodes) ID(*core.Node) string {
+	return nodeGroup
+}
@@ -0,0 +1,126 @@
+package xds
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dpup/esu"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type fakeLister struct {
+	tasks []esu.TaskInfo
+}
+
+func (f *fakeLister) Tasks(service string) ([]esu.TaskInfo, error) {
+	return f.tasks, nil
+}
+
+func task(ip, az string, health esu.ECSHealthStatus) esu.TaskInfo {
+	return esu.TaskInfo{
+		DesiredStatus:    esu.ECSTaskStatusRunning,
+		LastStatus:       esu.ECSTaskStatusRunning,
+		HealthStatus:     health,
+		EC2InstanceID:    "i-" + ip,
+		PrivateIPAddress: ip,
+		Port:             32768,
+		AvailabilityZone: az,
+	}
+}
+
+func TestClusterLoadAssignment(t *testing.T) {
+	cla := ClusterLoadAssignment("website", []esu.TaskInfo{
+		task("10.0.1.1", "us-east-1b", esu.ECSHealthStatusHealthy),
+		task("10.0.0.1", "us-east-1a", esu.ECSHealthStatusUnhealthy),
+		task("10.0.1.2", "us-east-1b", ""),
+	})
+	if cla.ClusterName != "website" || len(cla.Endpoints) != 2 {
+		t.Fatalf("unexpected assignment %v", cla)
+	}
+	a, b := cla.Endpoints[0], cla.Endpoints[1]
+	if a.Locality.Zone != "us-east-1a" || len(a.LbEndpoints) != 1 {
+		t.Errorf("unexpected locality %v", a)
+	}
+	if b.Locality.Zone != "us-east-1b" || len(b.LbEndpoints) != 2 {
+		t.Errorf("unexpected locality %v", b)
+	}
+	expected := []core.HealthStatus{core.HealthStatus_UNHEALTHY, core.HealthStatus_HEALTHY, core.HealthStatus_UNKNOWN}
+	for i, ep := range []*endpoint.LbEndpoint{a.LbEndpoints[0], b.LbEndpoints[0], b.LbEndpoints[1]} {
+		if ep.HealthStatus != expected[i] {
+			t.Errorf("endpoint %d health was %s, wanted %s", i, ep.HealthStatus, expected[i])
+		}
+	}
+	addr := a.LbEndpoints[0].GetEndpoint().Address.GetSocketAddress()
+	if addr.Address != "10.0.0.1" || addr.GetPortValue() != 32768 {
+		t.Errorf("unexpected address %v", addr)
+	}
+}
+
+func TestServerPushesUpdates(t *testing.T) {
+	lister := &fakeLister{tasks: []esu.TaskInfo{task("10.0.0.1", "us-east-1a", esu.ECSHealthStatusHealthy)}}
+	tm := esu.NewTaskMonitorWithLister(lister, "website")
+	tm.Update()
+
+	s := New()
+	s.AddService("website", tm)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := endpointservice.NewEndpointDiscoveryServiceClient(conn).StreamEndpoints(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &discovery.DiscoveryRequest{
+		Node:          &core.Node{Id: "envoy-1"},
+		TypeUrl:       resource.EndpointType,
+		ResourceNames: []string{"website"},
+	}
+	recv := func() *endpoint.ClusterLoadAssignment {
+		if err := stream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Resources) != 1 {
+			t.Fatalf("expected 1 resource, got %d", len(resp.Resources))
+		}
+		var cla endpoint.ClusterLoadAssignment
+		if err := resp.Resources[0].UnmarshalTo(&cla); err != nil {
+			t.Fatal(err)
+		}
+		req.VersionInfo = resp.VersionInfo
+		req.ResponseNonce = resp.Nonce
+		return &cla
+	}
+
+	if cla := recv(); len(cla.Endpoints) != 1 || len(cla.Endpoints[0].LbEndpoints) != 1 {
+		t.Errorf("unexpected initial assignment %v", cla)
+	}
+
+	lister.tasks = append(lister.tasks, task("10.0.0.2", "us-east-1b", esu.ECSHealthStatusHealthy))
+	tm.Update()
+	if cla := recv(); len(cla.Endpoints) != 2 {
+		t.Errorf("expected update with 2 localities, got %v", cla)
+	}
+}